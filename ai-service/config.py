@@ -9,6 +9,10 @@ class Config:
     QUEUE_NAME = "story_evaluation"
     DLQ_NAME = "story_evaluation_dlq"
     
+    # Retries (shared with the backend, which requeues failed stories)
+    STORY_MAX_ATTEMPTS = int(os.getenv("STORY_MAX_ATTEMPTS", "3"))
+    STORY_RETRY_DELAY_SECONDS = int(os.getenv("STORY_RETRY_DELAY_SECONDS", "60"))
+    
     # Database
     DB_HOST = os.getenv("DB_HOST", "localhost")
     DB_PORT = os.getenv("DB_PORT", "5432")
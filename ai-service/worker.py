@@ -49,10 +49,15 @@ class StoryEvaluationWorker:
         logger.info("Connected to PostgreSQL")
     
     def get_story(self, story_id: str) -> Optional[dict]:
-        """Fetch story from database."""
+        """Fetch story from database.
+
+        Audio stories are evaluated from their transcript, written by the
+        backend's transcription worker before the story is queued here.
+        """
         cursor = self.db_conn.cursor()
         cursor.execute("""
-            SELECT s.id, s.user_id, s.content, s.input_type, s.prompt_title, u.level
+            SELECT s.id, s.user_id, COALESCE(NULLIF(s.content, ''), s.transcript),
+                   s.input_type, s.prompt_title, u.level
             FROM stories s
             JOIN users u ON s.user_id = u.id
             WHERE s.id = %s
@@ -72,16 +77,77 @@ class StoryEvaluationWorker:
             }
         return None
     
+    def claim_story(self, story_id: str) -> Optional[int]:
+        """Mark a pending story as processing and count the attempt.
+
+        Returns the attempt number, or None if the story is not waiting for
+        evaluation (already handled, deleted, or a duplicate message). Stories left in
+        processing by a crashed worker can be claimed again after a while.
+        """
+        cursor = self.db_conn.cursor()
+        cursor.execute("""
+            UPDATE stories
+            SET status = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE id = %s AND deleted_at IS NULL AND (
+                status = 'pending'
+                OR (status = 'processing' AND updated_at < CURRENT_TIMESTAMP - INTERVAL '15 minutes')
+            )
+            RETURNING attempts
+        """, (story_id,))
+        row = cursor.fetchone()
+        self.db_conn.commit()
+        cursor.close()
+        return row[0] if row else None
+    
     def update_story_status(self, story_id: str, status: str):
         """Update story status in database."""
         cursor = self.db_conn.cursor()
         cursor.execute("""
-            UPDATE stories SET status = %s, updated_at = CURRENT_TIMESTAMP
+            UPDATE stories
+            SET status = %s, last_error = NULL, next_retry_at = NULL, updated_at = CURRENT_TIMESTAMP
             WHERE id = %s
         """, (status, story_id))
         self.db_conn.commit()
         cursor.close()
     
+    def record_failure(self, story_id: str, attempts: int, error: str) -> bool:
+        """Mark a story failed and schedule a retry if attempts remain.
+
+        The backend requeues the story at next_retry_at. The delay doubles
+        with every attempt, matching the backend's retry.Delay. Returns
+        whether a retry was scheduled.
+        """
+        retry = attempts < Config.STORY_MAX_ATTEMPTS
+        delay = min(Config.STORY_RETRY_DELAY_SECONDS * 2 ** (attempts - 1), 3600)
+        
+        cursor = self.db_conn.cursor()
+        cursor.execute("""
+            UPDATE stories
+            SET status = 'failed', last_error = %s, updated_at = CURRENT_TIMESTAMP,
+                next_retry_at = CASE WHEN %s THEN CURRENT_TIMESTAMP + make_interval(secs => %s) END
+            WHERE id = %s
+        """, (error[:500], retry, delay, story_id))
+        self.db_conn.commit()
+        cursor.close()
+        return retry
+    
+    def has_evaluated_revision(self, story_id: str) -> bool:
+        """Whether an earlier revision of the story has been scored.
+
+        The backend applies the same rule when a story is deleted or
+        restored (adjustSkillProgress).
+        """
+        cursor = self.db_conn.cursor()
+        cursor.execute("""
+            SELECT EXISTS(
+                SELECT 1 FROM story_revisions
+                WHERE story_id = %s AND overall_score IS NOT NULL
+            )
+        """, (story_id,))
+        row = cursor.fetchone()
+        cursor.close()
+        return bool(row and row[0])
+    
     def save_feedback(self, story_id: str, evaluation):
         """Save evaluation feedback to database."""
         cursor = self.db_conn.cursor()
@@ -122,7 +188,8 @@ class StoryEvaluationWorker:
         """Update user's skill progress based on evaluation."""
         cursor = self.db_conn.cursor()
         
-        # Map scores to skills
+        # Map scores to skills. The backend undoes this when a story is
+        # deleted (adjustSkillProgress), so keep the two in step.
         skill_scores = {
             "Kejelasan Bertutur": evaluation.clarity_score,
             "Alur Cerita": evaluation.structure_score,
@@ -168,10 +235,15 @@ class StoryEvaluationWorker:
         """Process a story evaluation message."""
         story_id = body.decode()
         logger.info(f"Processing story: {story_id}")
+        attempts = None
         
         try:
-            # Update status to processing
-            self.update_story_status(story_id, "processing")
+            # Claim the story; duplicates and finished stories are skipped
+            attempts = self.claim_story(story_id)
+            if attempts is None:
+                logger.info(f"Story {story_id} is not pending, skipping")
+                ch.basic_ack(delivery_tag=method.delivery_tag)
+                return
             
             # Get story from database
             story_data = self.get_story(story_id)
@@ -194,19 +266,22 @@ class StoryEvaluationWorker:
             result = evaluate_story(story_input)
             
             if result.evaluation:
+                # Only the story's first evaluation counts towards skill
+                # progress; a revision counts if none before it was scored
+                first_evaluation = not self.has_evaluated_revision(story_id)
+                
                 # Save feedback
                 self.save_feedback(story_id, result.evaluation)
                 
                 # Update skill progress
-                self.update_skill_progress(story_data["user_id"], result.evaluation)
+                if first_evaluation:
+                    self.update_skill_progress(story_data["user_id"], result.evaluation)
                 
                 # Update status to completed
                 self.update_story_status(story_id, "completed")
                 logger.info(f"Story evaluated successfully: {story_id}")
             else:
-                # Update status to failed
-                self.update_story_status(story_id, "failed")
-                logger.error(f"Evaluation failed for story: {story_id}")
+                self.fail(ch, story_id, attempts, result.error or "evaluation returned no result", body)
             
             # Acknowledge message
             ch.basic_ack(delivery_tag=method.delivery_tag)
@@ -214,25 +289,32 @@ class StoryEvaluationWorker:
         except Exception as e:
             logger.error(f"Error processing story {story_id}: {e}")
             
-            # Update status to failed
-            try:
-                self.update_story_status(story_id, "failed")
-            except Exception:
-                pass
-            
-            # Send to DLQ for retry
-            try:
-                ch.basic_publish(
-                    exchange="",
-                    routing_key=Config.DLQ_NAME,
-                    body=body,
-                )
-            except Exception:
-                pass
+            if attempts is not None:
+                try:
+                    self.db_conn.rollback()
+                    self.fail(ch, story_id, attempts, str(e), body)
+                except Exception:
+                    pass
             
             # Acknowledge original message
             ch.basic_ack(delivery_tag=method.delivery_tag)
     
+    def fail(self, ch, story_id: str, attempts: int, error: str, body: bytes):
+        """Record a failed attempt. Stories out of attempts go to the DLQ."""
+        if self.record_failure(story_id, attempts, error):
+            logger.error(f"Evaluation failed for story {story_id} (attempt {attempts}), will retry: {error}")
+            return
+        
+        logger.error(f"Evaluation failed for story {story_id} after {attempts} attempts: {error}")
+        try:
+            ch.basic_publish(
+                exchange="",
+                routing_key=Config.DLQ_NAME,
+                body=body,
+            )
+        except Exception:
+            pass
+    
     def start(self):
         """Start the worker."""
         self.connect_db()
@@ -0,0 +1,91 @@
+// Package audio identifies uploaded recordings by their content and reads
+// their duration, without decoding any audio.
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrUnsupportedFormat means the content is not one of the recording
+	// formats accepted for stories.
+	ErrUnsupportedFormat = errors.New("unsupported audio format")
+	// ErrUnknownDuration means the format was recognised but the file does
+	// not say how long it is, usually because it is truncated.
+	ErrUnknownDuration = errors.New("could not determine audio duration")
+)
+
+// Info describes a recording.
+type Info struct {
+	MIMEType  string
+	Extension string
+	Duration  time.Duration
+}
+
+type format struct {
+	mimeType  string
+	extension string
+	match     func(header []byte) bool
+	duration  func(r io.ReaderAt, size int64) (time.Duration, error)
+}
+
+// formats are the accepted containers, covering what phones (AAC in MP4),
+// browsers (Opus in WebM or Ogg) and desktop tools (WAV, MP3) record.
+var formats = []format{
+	{"audio/wav", ".wav", isWAV, wavDuration},
+	{"audio/mp4", ".m4a", isMP4, mp4Duration},
+	{"audio/webm", ".webm", isWebM, webmDuration},
+	{"audio/ogg", ".ogg", isOgg, oggDuration},
+	{"audio/mpeg", ".mp3", isMP3, mp3Duration},
+}
+
+// Probe sniffs the format of the size bytes in r and reads their duration.
+// The file name and declared content type are deliberately not consulted.
+func Probe(r io.ReaderAt, size int64) (Info, error) {
+	header := make([]byte, 64)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return Info{}, err
+	}
+	header = header[:n]
+
+	for _, f := range formats {
+		if !f.match(header) {
+			continue
+		}
+		d, err := f.duration(r, size)
+		if err != nil {
+			return Info{}, err
+		}
+		if d <= 0 {
+			return Info{}, ErrUnknownDuration
+		}
+		return Info{MIMEType: f.mimeType, Extension: f.extension, Duration: d}, nil
+	}
+	return Info{}, ErrUnsupportedFormat
+}
+
+// readAt reads exactly n bytes at off, treating a short read as a truncated
+// file.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	got, err := r.ReadAt(buf, off)
+	if got == n {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		err = ErrUnknownDuration
+	}
+	return nil, err
+}
+
+func hasPrefix(b []byte, prefix string) bool {
+	return bytes.HasPrefix(b, []byte(prefix))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
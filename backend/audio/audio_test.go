@@ -0,0 +1,139 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func probe(b []byte) (Info, error) {
+	return Probe(bytes.NewReader(b), int64(len(b)))
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		file     string
+		mimeType string
+		ext      string
+		duration time.Duration
+	}{
+		{"short.wav", "audio/wav", ".wav", 500 * time.Millisecond},
+		{"short.m4a", "audio/mp4", ".m4a", 2500 * time.Millisecond},
+		{"short.webm", "audio/webm", ".webm", 3 * time.Second},
+		{"live.webm", "audio/webm", ".webm", time.Second},
+		{"short.ogg", "audio/ogg", ".ogg", 2 * time.Second},
+		{"cbr.mp3", "audio/mpeg", ".mp3", 250 * time.Millisecond},
+		{"xing.mp3", "audio/mpeg", ".mp3", 100 * 1152 * time.Second / 44100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			info, err := probe(fixture(t, tt.file))
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+			if info.MIMEType != tt.mimeType || info.Extension != tt.ext {
+				t.Errorf("format = %s %s, want %s %s", info.MIMEType, info.Extension, tt.mimeType, tt.ext)
+			}
+			if diff := info.Duration - tt.duration; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("duration = %v, want %v", info.Duration, tt.duration)
+			}
+		})
+	}
+}
+
+func TestProbeTruncated(t *testing.T) {
+	tests := []struct {
+		file string
+		keep int
+	}{
+		{"short.wav", 30},
+		{"short.m4a", 40},
+		{"short.m4a", 100},
+		{"short.webm", 30},
+		{"short.webm", 35},
+		{"live.webm", 40},
+		{"short.ogg", 30},
+		{"xing.mp3", 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b := fixture(t, tt.file)[:tt.keep]
+			if _, err := probe(b); !errors.Is(err, ErrUnknownDuration) {
+				t.Errorf("Probe of %d bytes: err = %v, want %v", tt.keep, err, ErrUnknownDuration)
+			}
+		})
+	}
+}
+
+func TestProbeOversizedBox(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		modify func(b []byte)
+	}{
+		{"mp4 moov past end", "short.m4a", func(b []byte) {
+			// moov follows the 24-byte ftyp and 16-byte free boxes
+			binary.BigEndian.PutUint32(b[40:], 1<<20)
+		}},
+		{"mp4 mvhd past moov", "short.m4a", func(b []byte) {
+			binary.BigEndian.PutUint32(b[48:], 1<<20)
+		}},
+		{"mp4 box smaller than header", "short.m4a", func(b []byte) {
+			binary.BigEndian.PutUint32(b[24:], 4)
+		}},
+		{"mp4 64-bit size past end", "short.m4a", func(b []byte) {
+			binary.BigEndian.PutUint32(b[24:], 1)
+			binary.BigEndian.PutUint64(b[32:], 1<<40)
+		}},
+		{"webm info past end", "short.webm", func(b []byte) {
+			// Info's size follows the 12-byte EBML header, the Segment ID
+			// and size, and Info's ID
+			b[21] = 0xFE
+		}},
+		{"wav data before fmt", "short.wav", func(b []byte) {
+			copy(b[12:16], "junk")
+			binary.LittleEndian.PutUint32(b[16:], 0x7FFFFFF0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := fixture(t, tt.file)
+			tt.modify(b)
+			if _, err := probe(b); !errors.Is(err, ErrUnknownDuration) {
+				t.Errorf("err = %v, want %v", err, ErrUnknownDuration)
+			}
+		})
+	}
+}
+
+func TestProbeUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"text", []byte("hello, this is not a recording")},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")},
+		{"ogg theora", append([]byte("OggS\x00\x02"), make([]byte, 80)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := probe(tt.data); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("err = %v, want %v", err, ErrUnsupportedFormat)
+			}
+		})
+	}
+}
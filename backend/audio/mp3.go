@@ -0,0 +1,120 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// mp3SyncSearch is how far past the ID3 tag the first frame is looked for.
+const mp3SyncSearch = 64 * 1024
+
+var (
+	// Layer III bitrates in kbit/s by bitrate index
+	mp3Bitrates = map[bool][]int{
+		true:  {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		false: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	// Sample rates by version bits (3 = MPEG-1, 2 = MPEG-2, 0 = MPEG-2.5)
+	mp3SampleRates = map[byte][]int{
+		3: {44100, 48000, 32000},
+		2: {22050, 24000, 16000},
+		0: {11025, 12000, 8000},
+	}
+)
+
+func isMP3(h []byte) bool {
+	return hasPrefix(h, "ID3") || (len(h) >= 4 && isMP3Frame(h))
+}
+
+// isMP3Frame reports whether h starts with an MPEG audio layer III frame
+// header.
+func isMP3Frame(h []byte) bool {
+	return h[0] == 0xFF && h[1]&0xE0 == 0xE0 &&
+		(h[1]>>3)&3 != 1 && // reserved version
+		(h[1]>>1)&3 == 1 && // layer III
+		h[2]>>4 != 15 && (h[2]>>2)&3 != 3
+}
+
+// mp3Duration uses the frame count from a Xing/Info or VBRI header when the
+// encoder wrote one, and otherwise assumes a constant bitrate.
+func mp3Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	start := int64(0)
+	if id3, err := readAt(r, 0, 10); err == nil && hasPrefix(id3, "ID3") {
+		tagSize := int64(id3[6]&0x7F)<<21 | int64(id3[7]&0x7F)<<14 | int64(id3[8]&0x7F)<<7 | int64(id3[9]&0x7F)
+		start = 10 + tagSize
+		if id3[5]&0x10 != 0 {
+			start += 10
+		}
+	}
+
+	searchLen := int64(mp3SyncSearch)
+	if start+searchLen > size {
+		searchLen = size - start
+	}
+	if searchLen < 4 {
+		return 0, ErrUnknownDuration
+	}
+	buf, err := readAt(r, start, int(searchLen))
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i+4 <= len(buf); i++ {
+		h := buf[i:]
+		if h[0] != 0xFF || !isMP3Frame(h) {
+			continue
+		}
+
+		version := (h[1] >> 3) & 3
+		mpeg1 := version == 3
+		bitrate := mp3Bitrates[mpeg1][h[2]>>4] * 1000
+		sampleRate := mp3SampleRates[version][(h[2]>>2)&3]
+		samplesPerFrame := 576
+		if mpeg1 {
+			samplesPerFrame = 1152
+		}
+
+		if frames := mp3FrameCount(h, mpeg1); frames > 0 {
+			return seconds(float64(frames) * float64(samplesPerFrame) / float64(sampleRate)), nil
+		}
+
+		if bitrate == 0 {
+			return 0, ErrUnknownDuration
+		}
+		audioBytes := size - start - int64(i)
+		if tag, err := readAt(r, size-128, 3); err == nil && string(tag) == "TAG" {
+			audioBytes -= 128
+		}
+		return seconds(float64(audioBytes) * 8 / float64(bitrate)), nil
+	}
+	return 0, ErrUnknownDuration
+}
+
+// mp3FrameCount reads the number of frames from a Xing/Info or VBRI header
+// in the first frame, or returns 0 if there is none.
+func mp3FrameCount(frame []byte, mpeg1 bool) uint32 {
+	mono := frame[3]>>6 == 3
+	sideInfo := 17
+	switch {
+	case mpeg1 && !mono:
+		sideInfo = 32
+	case !mpeg1 && mono:
+		sideInfo = 9
+	}
+
+	if x := 4 + sideInfo; len(frame) >= x+12 {
+		tag := frame[x : x+4]
+		if bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info")) {
+			if binary.BigEndian.Uint32(frame[x+4:x+8])&1 != 0 {
+				return binary.BigEndian.Uint32(frame[x+8 : x+12])
+			}
+			return 0
+		}
+	}
+	if v := 4 + 32; len(frame) >= v+18 && bytes.Equal(frame[v:v+4], []byte("VBRI")) {
+		return binary.BigEndian.Uint32(frame[v+14 : v+18])
+	}
+	return 0
+}
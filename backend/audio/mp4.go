@@ -0,0 +1,87 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+func isMP4(h []byte) bool {
+	return len(h) >= 12 && string(h[4:8]) == "ftyp"
+}
+
+// mp4Duration reads the timescale and duration from the movie header
+// (moov/mvhd).
+func mp4Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	moovStart, moovEnd, err := findBox(r, 0, size, "moov")
+	if err != nil {
+		return 0, err
+	}
+	mvhdStart, _, err := findBox(r, moovStart, moovEnd, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := readAt(r, mvhdStart, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	var timescale uint32
+	var duration uint64
+	if version[0] == 1 {
+		b, err := readAt(r, mvhdStart+4+16, 12)
+		if err != nil {
+			return 0, err
+		}
+		timescale = binary.BigEndian.Uint32(b[0:4])
+		duration = binary.BigEndian.Uint64(b[4:12])
+	} else {
+		b, err := readAt(r, mvhdStart+4+8, 8)
+		if err != nil {
+			return 0, err
+		}
+		timescale = binary.BigEndian.Uint32(b[0:4])
+		duration = uint64(binary.BigEndian.Uint32(b[4:8]))
+	}
+
+	// Fragmented files leave the duration at zero (or all ones)
+	if timescale == 0 || duration == 0 || duration == 0xFFFFFFFF || duration == 1<<64-1 {
+		return 0, ErrUnknownDuration
+	}
+	return seconds(float64(duration) / float64(timescale)), nil
+}
+
+// findBox returns the payload range of the first box of type name between
+// start and end.
+func findBox(r io.ReaderAt, start, end int64, name string) (int64, int64, error) {
+	off := start
+	for off+8 <= end {
+		hdr, err := readAt(r, off, 8)
+		if err != nil {
+			return 0, 0, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = end - off
+		case 1:
+			large, err := readAt(r, off+8, 8)
+			if err != nil {
+				return 0, 0, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(large))
+			headerSize = 16
+		}
+		if boxSize < headerSize || off+boxSize > end {
+			return 0, 0, ErrUnknownDuration
+		}
+
+		if string(hdr[4:8]) == name {
+			return off + headerSize, off + boxSize, nil
+		}
+		off += boxSize
+	}
+	return 0, 0, ErrUnknownDuration
+}
@@ -0,0 +1,70 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// oggTailSize is how much of the end of the file is searched for the last
+// page. Ogg pages are at most about 64KB.
+const oggTailSize = 65536 + 27 + 255
+
+func isOgg(h []byte) bool {
+	return hasPrefix(h, "OggS")
+}
+
+// oggDuration reads the granule position of the last page, which counts
+// samples, and the sample rate from the Opus or Vorbis header.
+func oggDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	first, err := readAt(r, 0, 27)
+	if err != nil {
+		return 0, err
+	}
+	segments := int(first[26])
+	packet, err := readAt(r, int64(27+segments), 19)
+	if err != nil {
+		return 0, err
+	}
+
+	var rate, preSkip uint64
+	switch {
+	case hasPrefix(packet, "OpusHead"):
+		// Opus granule positions always count 48kHz samples
+		rate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(packet[10:12]))
+	case hasPrefix(packet, "\x01vorbis"):
+		rate = uint64(binary.LittleEndian.Uint32(packet[12:16]))
+	default:
+		return 0, ErrUnsupportedFormat
+	}
+	if rate == 0 {
+		return 0, ErrUnknownDuration
+	}
+
+	tailStart := size - oggTailSize
+	if tailStart < 0 {
+		tailStart = 0
+	}
+	tail, err := readAt(r, tailStart, int(size-tailStart))
+	if err != nil {
+		return 0, err
+	}
+
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		if i+14 > len(tail) || tail[i+4] != 0 {
+			continue
+		}
+		granule := binary.LittleEndian.Uint64(tail[i+6 : i+14])
+		// -1 marks a page on which no packet ends
+		if granule == 1<<64-1 {
+			continue
+		}
+		if granule <= preSkip {
+			return 0, ErrUnknownDuration
+		}
+		return seconds(float64(granule-preSkip) / float64(rate)), nil
+	}
+	return 0, ErrUnknownDuration
+}
@@ -0,0 +1,49 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+func isWAV(h []byte) bool {
+	return len(h) >= 12 && hasPrefix(h, "RIFF") && string(h[8:12]) == "WAVE"
+}
+
+// wavDuration divides the size of the data chunk by the byte rate from the
+// fmt chunk.
+func wavDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	var byteRate uint32
+	off := int64(12)
+	for off+8 <= size {
+		hdr, err := readAt(r, off, 8)
+		if err != nil {
+			return 0, err
+		}
+		id := string(hdr[:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		off += 8
+
+		switch id {
+		case "fmt ":
+			fmtChunk, err := readAt(r, off, 16)
+			if err != nil {
+				return 0, err
+			}
+			byteRate = binary.LittleEndian.Uint32(fmtChunk[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, ErrUnknownDuration
+			}
+			// Recorders that stream to disk may leave the size unset
+			if chunkSize == 0 || chunkSize == 0xFFFFFFFF || off+chunkSize > size {
+				chunkSize = size - off
+			}
+			return seconds(float64(chunkSize) / float64(byteRate)), nil
+		}
+
+		// Chunks are padded to an even size
+		off += chunkSize + chunkSize%2
+	}
+	return 0, ErrUnknownDuration
+}
@@ -0,0 +1,252 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// EBML element IDs used to find the duration of a WebM file.
+const (
+	ebmlHeaderID    = 0x1A45DFA3
+	segmentID       = 0x18538067
+	infoID          = 0x1549A966
+	timecodeScaleID = 0x2AD7B1
+	durationID      = 0x4489
+	clusterID       = 0x1F43B675
+	timecodeID      = 0xE7
+	simpleBlockID   = 0xA3
+	blockGroupID    = 0xA0
+	blockID         = 0xA1
+)
+
+// ebmlUnknownSize marks an element whose size was not known when it was
+// written, as in live recordings.
+const ebmlUnknownSize = -1
+
+func isWebM(h []byte) bool {
+	return hasPrefix(h, "\x1A\x45\xDF\xA3") && bytes.Contains(h, []byte("webm"))
+}
+
+// webmDuration reads Segment/Info/Duration. Browsers recording with
+// MediaRecorder do not write it, so without it the clusters are scanned for
+// the timecode of the last block.
+func webmDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	e := &ebmlReader{r: bufio.NewReader(io.NewSectionReader(r, 0, size)), size: size}
+
+	// EBML header
+	id, n, err := e.element()
+	if err != nil || id != ebmlHeaderID {
+		return 0, ErrUnsupportedFormat
+	}
+	if err := e.skip(n); err != nil {
+		return 0, err
+	}
+
+	id, n, err = e.element()
+	if err != nil || id != segmentID {
+		return 0, ErrUnknownDuration
+	}
+	segmentEnd := size
+	if n != ebmlUnknownSize && e.pos+n < size {
+		segmentEnd = e.pos + n
+	}
+
+	scale := uint64(1000000)
+	var declared float64
+	var clusterTime, lastBlock int64 = 0, -1
+
+	// Clusters are entered rather than skipped, so their children appear in
+	// this loop too. That also handles clusters of unknown size.
+	for e.pos < segmentEnd {
+		id, n, err := e.element()
+		if err != nil {
+			break
+		}
+
+		switch id {
+		case infoID:
+			if n == ebmlUnknownSize {
+				return 0, ErrUnknownDuration
+			}
+			end := e.pos + n
+			for e.pos < end {
+				cid, cn, err := e.element()
+				if err != nil || cn == ebmlUnknownSize {
+					return 0, ErrUnknownDuration
+				}
+				b, err := e.read(cn)
+				if err != nil {
+					return 0, err
+				}
+				switch cid {
+				case timecodeScaleID:
+					scale = ebmlUint(b)
+				case durationID:
+					declared = ebmlFloat(b)
+				}
+			}
+			if declared > 0 {
+				return time.Duration(declared * float64(scale)), nil
+			}
+		case clusterID, blockGroupID:
+			// Descend into the children
+		case timecodeID:
+			b, err := e.read(n)
+			if err != nil {
+				return 0, err
+			}
+			clusterTime = int64(ebmlUint(b))
+		case simpleBlockID, blockID:
+			if n == ebmlUnknownSize {
+				return 0, ErrUnknownDuration
+			}
+			// Track number (a vint), then a signed 16-bit timecode relative
+			// to the cluster
+			b, err := e.read(n)
+			if err != nil {
+				break
+			}
+			if t, ok := blockTimecode(b); ok && clusterTime+t > lastBlock {
+				lastBlock = clusterTime + t
+			}
+		default:
+			if n == ebmlUnknownSize {
+				break
+			}
+			if err := e.skip(n); err != nil {
+				break
+			}
+		}
+	}
+
+	if lastBlock <= 0 {
+		return 0, ErrUnknownDuration
+	}
+	// The last block still has to be played; Opus frames are 20ms
+	return time.Duration(uint64(lastBlock)*scale) + 20*time.Millisecond, nil
+}
+
+type ebmlReader struct {
+	r    *bufio.Reader
+	pos  int64
+	size int64
+}
+
+// element reads an element ID and data size. The size is ebmlUnknownSize
+// for elements of unknown size.
+func (e *ebmlReader) element() (uint64, int64, error) {
+	id, _, err := e.vint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, allOnes, err := e.vint(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if allOnes {
+		return id, ebmlUnknownSize, nil
+	}
+	if size > uint64(e.size) {
+		return 0, 0, ErrUnknownDuration
+	}
+	return id, int64(size), nil
+}
+
+// vint reads a variable-length integer. IDs keep their length marker; sizes
+// do not. allOnes reports the reserved "unknown" value.
+func (e *ebmlReader) vint(keepMarker bool) (uint64, bool, error) {
+	first, err := e.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	e.pos++
+
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, false, ErrUnknownDuration
+	}
+
+	value := uint64(first)
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := e.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		e.pos++
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	return value, allOnes && !keepMarker, nil
+}
+
+func (e *ebmlReader) read(n int64) ([]byte, error) {
+	if n > 1<<20 {
+		return nil, ErrUnknownDuration
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(e.r, b); err != nil {
+		return nil, truncated(err)
+	}
+	e.pos += n
+	return b, nil
+}
+
+func (e *ebmlReader) skip(n int64) error {
+	if _, err := e.r.Discard(int(n)); err != nil {
+		return truncated(err)
+	}
+	e.pos += n
+	return nil
+}
+
+// truncated treats running out of data inside an element like readAt does.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrUnknownDuration
+	}
+	return err
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// blockTimecode returns the cluster-relative timecode of a (Simple)Block.
+func blockTimecode(b []byte) (int64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	trackLen := 1
+	for mask := byte(0x80); trackLen <= 8 && b[0]&mask == 0; mask >>= 1 {
+		trackLen++
+	}
+	if len(b) < trackLen+2 {
+		return 0, false
+	}
+	return int64(int16(binary.BigEndian.Uint16(b[trackLen : trackLen+2]))), true
+}
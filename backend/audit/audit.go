@@ -0,0 +1,174 @@
+// Package audit records security-relevant events in the append-only
+// audit_events table.
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Event types. Names are "<area>.<what happened>" so that a whole area can be
+// queried with a prefix such as "auth.*".
+const (
+	UserRegistered = "auth.registered"
+
+	LoginSucceeded     = "auth.login_succeeded"
+	LoginFailed        = "auth.login_failed"
+	LoginLocked        = "auth.login_locked"
+	MFAChallengeFailed = "auth.mfa_failed"
+	TokenRefreshed     = "auth.token_refreshed"
+	RefreshTokenReused = "auth.refresh_token_reused"
+	RevokedTokenUsed   = "auth.revoked_token_used"
+	Logout             = "auth.logout"
+	SessionRevoked     = "auth.session_revoked"
+
+	PasswordChanged          = "account.password_changed"
+	PasswordReset            = "account.password_reset"
+	ProfileUpdated           = "account.profile_updated"
+	EmailVerified            = "account.email_verified"
+	MFAEnabled               = "account.mfa_enabled"
+	MFADisabled              = "account.mfa_disabled"
+	RecoveryCodeUsed         = "account.recovery_code_used"
+	RecoveryCodesRegenerated = "account.recovery_codes_regenerated"
+	PINReset                 = "account.pin_reset"
+	OrganizationJoined       = "account.organization_joined"
+	OrganizationLeft         = "account.organization_left"
+
+	ChildCreated     = "guardian.child_created"
+	GuardianLinked   = "guardian.linked"
+	GuardianApproved = "guardian.approved"
+	GuardianUnlinked = "guardian.unlinked"
+	ConsentGranted   = "guardian.consent_granted"
+	ConsentRequested = "guardian.consent_requested"
+
+	DataExportRequested  = "privacy.export_requested"
+	DataExportDownloaded = "privacy.export_downloaded"
+	DeletionRequested    = "privacy.deletion_requested"
+	DeletionCancelled    = "privacy.deletion_cancelled"
+	AccountDeleted       = "privacy.account_deleted"
+
+	RoleChanged      = "admin.role_changed"
+	UserBanned       = "admin.user_banned"
+	UserUnbanned     = "admin.user_unbanned"
+	UserUnlocked     = "admin.user_unlocked"
+	MFAReset         = "admin.mfa_reset"
+	MFAPolicyChanged = "admin.mfa_policy_changed"
+
+	OrganizationCreated     = "admin.organization_created"
+	OrganizationMemberAdded = "admin.organization_member_added"
+	APIKeyCreated           = "admin.api_key_created"
+	APIKeyRevoked           = "admin.api_key_revoked"
+
+	RosterSynced        = "integration.roster_synced"
+	RosterMemberRemoved = "integration.roster_member_removed"
+)
+
+// Target types.
+const (
+	TargetUser         = "user"
+	TargetSession      = "session"
+	TargetGuardianship = "guardianship"
+	TargetDataExport   = "data_export"
+	TargetRole         = "role"
+	TargetOrganization = "organization"
+	TargetAPIKey       = "api_key"
+)
+
+// Event is one audit record. ActorID is who acted (empty for anonymous
+// requests, API keys and background jobs), TargetID the user or object acted
+// upon.
+type Event struct {
+	Type       string
+	ActorID    string
+	ActorRole  string
+	TargetID   string
+	TargetType string
+	SessionID  string
+	IPAddress  string
+	UserAgent  string
+	Metadata   map[string]interface{}
+}
+
+// Recorder writes audit events. Failures are logged and never fail the
+// request that triggered the event.
+type Recorder struct {
+	db *sql.DB
+}
+
+func NewRecorder(db *sql.DB) *Recorder {
+	return &Recorder{db: db}
+}
+
+// Record stores e. It must not be called while a transaction is open on the
+// same pool.
+func (r *Recorder) Record(e Event) {
+	if r == nil {
+		return
+	}
+
+	metadata := []byte("{}")
+	if len(e.Metadata) > 0 {
+		if b, err := json.Marshal(e.Metadata); err == nil {
+			metadata = b
+		}
+	}
+
+	_, err := r.db.Exec(`
+		INSERT INTO audit_events
+			(event_type, actor_id, actor_role, target_id, target_type, session_id, ip_address, user_agent, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, e.Type, nullUUID(e.ActorID), nullString(e.ActorRole, 20), nullUUID(e.TargetID),
+		nullString(e.TargetType, 30), nullUUID(e.SessionID), nullString(e.IPAddress, 45),
+		nullString(e.UserAgent, 255), metadata)
+	if err != nil {
+		log.Printf("Warning: failed to record audit event %s: %v", e.Type, err)
+	}
+}
+
+// Request records an event caused by the current request. The actor and
+// session are taken from the authenticated caller; targetID may be empty.
+func (r *Recorder) Request(c *fiber.Ctx, eventType, targetType, targetID string, metadata map[string]interface{}) {
+	actorID, _ := c.Locals("userID").(string)
+	role, _ := c.Locals("role").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	r.RequestBy(c, actorID, role, sessionID, eventType, targetType, targetID, metadata)
+}
+
+// RequestBy is Request for requests that are not authenticated yet, such as
+// logins, where the actor is known only from the request body.
+func (r *Recorder) RequestBy(c *fiber.Ctx, actorID, actorRole, sessionID, eventType, targetType, targetID string, metadata map[string]interface{}) {
+	r.Record(Event{
+		Type:       eventType,
+		ActorID:    actorID,
+		ActorRole:  actorRole,
+		TargetID:   targetID,
+		TargetType: targetType,
+		SessionID:  sessionID,
+		IPAddress:  c.IP(),
+		UserAgent:  c.Get(fiber.HeaderUserAgent),
+		Metadata:   metadata,
+	})
+}
+
+func nullUUID(s string) interface{} {
+	if _, err := uuid.Parse(s); err != nil {
+		return nil
+	}
+	return s
+}
+
+func nullString(s string, max int) interface{} {
+	if s == "" {
+		return nil
+	}
+	r := []rune(s)
+	if len(r) > max {
+		return string(r[:max])
+	}
+	return s
+}
@@ -3,9 +3,11 @@ package database
 import (
 	"database/sql"
 	"log"
+
+	"github.com/gili/backend/config"
 )
 
-func Migrate(db *sql.DB) error {
+func Migrate(db *sql.DB, cfg *config.Config) error {
 	migrations := []string{
 		// Users table
 		`CREATE TABLE IF NOT EXISTS users (
@@ -24,8 +26,258 @@ func Migrate(db *sql.DB) error {
 		`CREATE TABLE IF NOT EXISTS refresh_tokens (
 			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-			token VARCHAR(255) UNIQUE NOT NULL,
+			family_id UUID NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			replaced_by UUID REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Refresh tokens: hashed storage and rotation families.
+		// Legacy plaintext rows cannot be migrated and are dropped.
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS family_id UUID`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64)`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS replaced_by UUID REFERENCES refresh_tokens(id) ON DELETE SET NULL`,
+		`DELETE FROM refresh_tokens WHERE token_hash IS NULL OR family_id IS NULL`,
+		`ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS token`,
+		`ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL`,
+		`ALTER TABLE refresh_tokens ALTER COLUMN token_hash SET NOT NULL`,
+
+		// Sessions table (one per login; the ID doubles as the refresh token family)
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id UUID PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			device_name VARCHAR(100),
+			platform VARCHAR(20),
+			app_version VARCHAR(50),
+			ip_address VARCHAR(45),
+			last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Backfill sessions for refresh token families issued before sessions existed
+		`INSERT INTO sessions (id, user_id, last_used_at, created_at)
+		SELECT family_id, user_id, MAX(created_at), MIN(created_at)
+		FROM refresh_tokens GROUP BY family_id, user_id
+		ON CONFLICT (id) DO NOTHING`,
+
+		// Password reset codes (single use, stored as bcrypt hashes)
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(255) NOT NULL,
+			attempts INTEGER DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Email verification
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Roles and bans
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'student'
+			CHECK (role IN ('student', 'parent', 'teacher', 'admin'))`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP`,
+
+		// JWT signing keys (private keys encrypted with JWT_SECRET)
+		`CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+			kid VARCHAR(64) PRIMARY KEY,
+			algorithm VARCHAR(10) NOT NULL DEFAULT 'RS256',
+			private_key BYTEA NOT NULL,
+			activates_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Managed child accounts: no email or password, username + PIN instead
+		`ALTER TABLE users ALTER COLUMN email DROP NOT NULL`,
+		`ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS username VARCHAR(30) UNIQUE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS login_code VARCHAR(12) UNIQUE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS pin_hash VARCHAR(255)`,
+
+		// Guardianships link a parent or teacher to a child account
+		`CREATE TABLE IF NOT EXISTS guardianships (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			guardian_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			child_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			relationship VARCHAR(20) NOT NULL CHECK (relationship IN ('parent', 'teacher')),
+			status VARCHAR(20) DEFAULT 'active' CHECK (status IN ('pending', 'active')),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(guardian_id, child_id)
+		)`,
+
+		// Guardian linking: invite codes issued by the child, approval by the child or an admin
+		`ALTER TABLE guardianships ADD COLUMN IF NOT EXISTS approved_by UUID REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE guardianships ADD COLUMN IF NOT EXISTS approved_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS guardianship_invites (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			child_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Parental consent for young users
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS consent_status VARCHAR(20) NOT NULL DEFAULT 'not_required'
+			CHECK (consent_status IN ('not_required', 'pending', 'granted'))`,
+		`CREATE TABLE IF NOT EXISTS consent_requests (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			child_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			guardian_email VARCHAR(255) NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS consent_records (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			child_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			guardian_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			guardian_email VARCHAR(255),
+			method VARCHAR(30) NOT NULL CHECK (method IN ('guardian_account', 'email', 'account_created_by_guardian')),
+			policy_version VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(45),
+			granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Account deletion (grace period before anonymisation) and data exports
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS data_exports (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processing', 'ready', 'failed')),
+			file_path VARCHAR(500),
+			size_bytes BIGINT,
+			error TEXT,
+			started_at TIMESTAMP,
+			completed_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// TOTP two-factor authentication (secrets encrypted with JWT_SECRET)
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_enabled_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS mfa_totp (
+			user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			secret BYTEA NOT NULL,
+			confirmed_at TIMESTAMP,
+			last_used_step BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_challenges (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			device_name VARCHAR(100),
+			platform VARCHAR(20),
+			app_version VARCHAR(50),
+			attempts INTEGER DEFAULT 0,
 			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_role_policies (
+			role VARCHAR(20) PRIMARY KEY CHECK (role IN ('parent', 'teacher', 'admin')),
+			required BOOLEAN NOT NULL DEFAULT false,
+			updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO mfa_role_policies (role) VALUES ('parent'), ('teacher'), ('admin')
+		ON CONFLICT (role) DO NOTHING`,
+
+		// Security audit log (append-only: updates and deletes are rejected,
+		// except removing the IP address and user agent)
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id BIGSERIAL PRIMARY KEY,
+			event_type VARCHAR(64) NOT NULL,
+			actor_id UUID,
+			actor_role VARCHAR(20),
+			target_id UUID,
+			target_type VARCHAR(30),
+			session_id UUID,
+			ip_address VARCHAR(45),
+			user_agent VARCHAR(255),
+			metadata JSONB NOT NULL DEFAULT '{}',
+			occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP = 'UPDATE' AND NEW.ip_address IS NULL AND NEW.user_agent IS NULL
+			   AND (NEW.id, NEW.event_type, NEW.actor_id, NEW.actor_role, NEW.target_id, NEW.target_type,
+			        NEW.session_id, NEW.metadata, NEW.occurred_at)
+			       IS NOT DISTINCT FROM
+			       (OLD.id, OLD.event_type, OLD.actor_id, OLD.actor_role, OLD.target_id, OLD.target_type,
+			        OLD.session_id, OLD.metadata, OLD.occurred_at) THEN
+				RETURN NEW;
+			END IF;
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`,
+		`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events`,
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+
+		// Organizations (schools) and their API keys for system integrations
+		`CREATE TABLE IF NOT EXISTS organizations (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(200) NOT NULL,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS organization_members (
+			organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			external_id VARCHAR(100) NOT NULL,
+			class_name VARCHAR(100),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (organization_id, user_id),
+			UNIQUE (organization_id, external_id)
+		)`,
+		// Roster sync only invites an account; it joins once its holder
+		// accepts or an admin attaches it. Earlier links become invitations.
+		`ALTER TABLE organization_members ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'invited'
+			CHECK (status IN ('invited', 'active', 'declined'))`,
+		`ALTER TABLE organization_members ADD COLUMN IF NOT EXISTS approved_by UUID REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE organization_members ADD COLUMN IF NOT EXISTS approved_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			key_prefix VARCHAR(20) NOT NULL,
+			key_hash VARCHAR(64) NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL DEFAULT '{}',
+			rate_limit INTEGER NOT NULL,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			last_used_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
 
@@ -43,6 +295,63 @@ func Migrate(db *sql.DB) error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		// Uploaded recordings live in blob storage under audio_key
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS audio_key VARCHAR(500)`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS audio_content_type VARCHAR(50)`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS audio_duration_ms INTEGER`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS audio_size_bytes BIGINT`,
+		// Uploaded recordings are transcribed before they are evaluated
+		`ALTER TABLE stories DROP CONSTRAINT IF EXISTS stories_status_check`,
+		`ALTER TABLE stories ADD CONSTRAINT stories_status_check CHECK (status IN (
+			'pending_transcription', 'transcribing', 'transcription_failed',
+			'pending', 'processing', 'completed', 'failed'))`,
+		// Failed transcriptions and evaluations are retried with backoff
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS last_error TEXT`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMP`,
+		// Rewrites: stories keep their current revision, earlier ones are
+		// kept in story_revisions
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS revised_at TIMESTAMP`,
+		// Soft delete: hidden at once, removed after STORY_RESTORE_WINDOW
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		// Full-text search with the Indonesian stemmer; titles rank highest
+		`ALTER TABLE stories ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('indonesian', COALESCE(prompt_title, '')), 'A') ||
+			setweight(to_tsvector('indonesian', COALESCE(content, '')), 'B') ||
+			setweight(to_tsvector('indonesian', COALESCE(transcript, '')), 'B')
+		) STORED`,
+
+		// Resumable recording uploads; the data is kept in upload_chunks
+		`CREATE TABLE IF NOT EXISTS upload_sessions (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			prompt_id VARCHAR(50),
+			prompt_title VARCHAR(255),
+			story_id UUID REFERENCES stories(id) ON DELETE SET NULL,
+			expires_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// Offline sync: the story ID chosen by the app and when it was recorded
+		`ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS client_story_id UUID`,
+		`ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS recorded_at TIMESTAMP`,
+		// Set while one request turns the upload into a story
+		`ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS completing_until TIMESTAMP`,
+		// One blob per received chunk, so that any instance can take the next
+		// one. No foreign key: chunks outlive their upload until the cleanup
+		// has deleted their blobs.
+		`CREATE TABLE IF NOT EXISTS upload_chunks (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			upload_id UUID NOT NULL,
+			start_offset BIGINT NOT NULL,
+			size BIGINT NOT NULL,
+			blob_key VARCHAR(500) NOT NULL,
+			committed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
 
 		// Story feedback table
 		`CREATE TABLE IF NOT EXISTS story_feedback (
@@ -58,6 +367,62 @@ func Migrate(db *sql.DB) error {
 			improvements TEXT[],
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE story_feedback ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('indonesian', COALESCE(feedback_text, '')), 'C')
+		) STORED`,
+
+		// Earlier revisions of a story with the feedback they received
+		`CREATE TABLE IF NOT EXISTS story_revisions (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			story_id UUID NOT NULL REFERENCES stories(id) ON DELETE CASCADE,
+			revision INTEGER NOT NULL,
+			input_type VARCHAR(20) NOT NULL,
+			content TEXT,
+			transcript TEXT,
+			audio_key VARCHAR(500),
+			audio_duration_ms INTEGER,
+			status VARCHAR(30) NOT NULL,
+			clarity_score INTEGER,
+			structure_score INTEGER,
+			creativity_score INTEGER,
+			expression_score INTEGER,
+			overall_score INTEGER,
+			feedback_text TEXT,
+			strengths TEXT[],
+			improvements TEXT[],
+			submitted_at TIMESTAMP NOT NULL,
+			evaluated_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(story_id, revision)
+		)`,
+
+		// Story events for the API's event stream (package events). Triggers
+		// catch status changes written by the AI worker as well as the API.
+		`CREATE OR REPLACE FUNCTION notify_story_event() RETURNS trigger AS $$
+		BEGIN
+			IF TG_TABLE_NAME = 'story_feedback' THEN
+				PERFORM pg_notify('story_events', json_build_object(
+					'type', 'feedback_ready', 'story_id', NEW.story_id,
+					'user_id', (SELECT user_id FROM stories WHERE id = NEW.story_id),
+					'overall_score', NEW.overall_score)::text);
+			ELSIF TG_OP = 'UPDATE' AND NEW.deleted_at IS DISTINCT FROM OLD.deleted_at THEN
+				PERFORM pg_notify('story_events', json_build_object(
+					'type', CASE WHEN NEW.deleted_at IS NULL THEN 'restored' ELSE 'deleted' END,
+					'story_id', NEW.id, 'user_id', NEW.user_id, 'status', NEW.status)::text);
+			ELSIF TG_OP = 'INSERT' OR NEW.status IS DISTINCT FROM OLD.status THEN
+				PERFORM pg_notify('story_events', json_build_object(
+					'type', 'status', 'story_id', NEW.id, 'user_id', NEW.user_id,
+					'status', NEW.status, 'revision', NEW.revision)::text);
+			END IF;
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS stories_notify ON stories`,
+		`CREATE TRIGGER stories_notify AFTER INSERT OR UPDATE OF status, deleted_at ON stories
+			FOR EACH ROW EXECUTE FUNCTION notify_story_event()`,
+		`DROP TRIGGER IF EXISTS story_feedback_notify ON story_feedback`,
+		`CREATE TRIGGER story_feedback_notify AFTER INSERT OR UPDATE ON story_feedback
+			FOR EACH ROW EXECUTE FUNCTION notify_story_event()`,
 
 		// Skills table
 		`CREATE TABLE IF NOT EXISTS skills (
@@ -95,6 +460,36 @@ func Migrate(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_story_feedback_story_id ON story_feedback(story_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_skill_progress_user_id ON skill_progress(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens(token_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id ON email_verifications(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_guardianships_child_id ON guardianships(child_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_guardianship_invites_child_id ON guardianship_invites(child_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_consent_records_child_id ON consent_records(child_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_mfa_challenges_user_id ON mfa_challenges(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_occurred_at ON audit_events(occurred_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_target_id ON audit_events(target_id, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_event_type ON audit_events(event_type, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_organization_members_user_id ON organization_members(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_organization_id ON api_keys(organization_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_upload_sessions_user_id ON upload_sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_upload_chunks_upload_id ON upload_chunks(upload_id, start_offset)`,
+		// One feedback row per story; the AI worker upserts on story_id when a
+		// revision is re-evaluated
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_story_feedback_story_id_unique ON story_feedback(story_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_stories_next_retry_at ON stories(next_retry_at) WHERE next_retry_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_stories_search_vector ON stories USING GIN (search_vector)`,
+		`CREATE INDEX IF NOT EXISTS idx_story_feedback_search_vector ON story_feedback USING GIN (search_vector)`,
+		// Keyset pagination of a student's stories (GetStories)
+		`CREATE INDEX IF NOT EXISTS idx_stories_user_created ON stories(user_id, created_at DESC, id DESC) WHERE deleted_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_stories_deleted_at ON stories(deleted_at) WHERE deleted_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL`,
 	}
 
 	for _, migration := range migrations {
@@ -105,6 +500,15 @@ func Migrate(db *sql.DB) error {
 		}
 	}
 
+	// Students from before consent tracking, or without a stated age, need
+	// consent like new accounts
+	if _, err := db.Exec(`
+		UPDATE users SET consent_status = 'pending'
+		WHERE role = 'student' AND consent_status = 'not_required' AND (age IS NULL OR age < $1)
+	`, cfg.ConsentAgeThreshold); err != nil {
+		log.Printf("Migration error: %v\nQuery: consent_status backfill", err)
+	}
+
 	log.Println("✅ Database migrations completed")
 	return nil
 }
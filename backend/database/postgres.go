@@ -9,12 +9,7 @@ import (
 )
 
 func Connect(cfg *config.Config) (*sql.DB, error) {
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode,
-	)
-
-	db, err := sql.Open("postgres", dsn)
+	db, err := sql.Open("postgres", dsn(cfg, cfg.DBHost, cfg.DBPort))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -30,3 +25,16 @@ func Connect(cfg *config.Config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// ListenerDSN returns the connection string for LISTEN connections, which
+// must bypass a transaction pooler.
+func ListenerDSN(cfg *config.Config) string {
+	return dsn(cfg, cfg.DBListenHost, cfg.DBListenPort)
+}
+
+func dsn(cfg *config.Config, host, port string) string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		host, port, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode,
+	)
+}
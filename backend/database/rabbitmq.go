@@ -25,7 +25,7 @@ func ConnectRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 	}
 
 	// Declare queues
-	queues := []string{"story_evaluation", "story_evaluation_dlq"}
+	queues := []string{"story_transcription", "story_evaluation", "story_evaluation_dlq", "data_export"}
 	for _, q := range queues {
 		_, err := ch.QueueDeclare(
 			q,     // name
@@ -74,3 +74,66 @@ func (r *RabbitMQ) PublishStoryEvaluation(storyID string) error {
 		},
 	)
 }
+
+func (r *RabbitMQ) PublishStoryTranscription(storyID string) error {
+	if r == nil || r.Channel == nil {
+		log.Println("Warning: RabbitMQ not available, skipping publish")
+		return nil
+	}
+
+	return r.Channel.Publish(
+		"",                    // exchange
+		"story_transcription", // routing key
+		false,                 // mandatory
+		false,                 // immediate
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        []byte(storyID),
+		},
+	)
+}
+
+func (r *RabbitMQ) PublishDataExport(exportID string) error {
+	if r == nil || r.Channel == nil {
+		log.Println("Warning: RabbitMQ not available, skipping publish")
+		return nil
+	}
+
+	return r.Channel.Publish(
+		"",            // exchange
+		"data_export", // routing key
+		false,         // mandatory
+		false,         // immediate
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        []byte(exportID),
+		},
+	)
+}
+
+// Consume opens a dedicated channel and starts consuming queue with manual
+// acknowledgements.
+func (r *RabbitMQ) Consume(queue string) (<-chan amqp.Delivery, error) {
+	if r == nil || r.Conn == nil {
+		return nil, amqp.ErrClosed
+	}
+
+	ch, err := r.Conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return ch.Consume(
+		queue, // queue
+		"",    // consumer
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // args
+	)
+}
@@ -0,0 +1,165 @@
+// Package events delivers story status changes to connected clients. Database
+// triggers publish every change on the story_events channel with NOTIFY, so
+// changes made by the AI worker or another API instance reach the instance
+// the student is connected to.
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/database"
+	"github.com/lib/pq"
+)
+
+// channel is the NOTIFY channel the database triggers publish on.
+const channel = "story_events"
+
+// subscriberBuffer is how many events may wait for a slow client before it
+// is disconnected; the client reconnects and fetches the current state.
+const subscriberBuffer = 32
+
+// Event types. Resync is sent after the connection to the database was lost
+// and events may have been missed.
+const (
+	TypeStatus        = "status"
+	TypeFeedbackReady = "feedback_ready"
+	TypeDeleted       = "deleted"
+	TypeRestored      = "restored"
+	TypeResync        = "resync"
+)
+
+// Event is one change to a story, as published by the notify_story_event
+// trigger.
+type Event struct {
+	Type         string `json:"type"`
+	StoryID      string `json:"story_id,omitempty"`
+	UserID       string `json:"-"`
+	Status       string `json:"status,omitempty"`
+	Revision     int    `json:"revision,omitempty"`
+	OverallScore *int   `json:"overall_score,omitempty"`
+}
+
+// Hub listens for story events and fans them out to the subscribers of the
+// story's owner.
+type Hub struct {
+	dsn string
+
+	mu   sync.Mutex
+	subs map[string]map[chan Event]struct{}
+}
+
+func NewHub(cfg *config.Config) *Hub {
+	return &Hub{
+		dsn:  database.ListenerDSN(cfg),
+		subs: map[string]map[chan Event]struct{}{},
+	}
+}
+
+// Start opens the LISTEN connection, which reconnects by itself. It returns
+// immediately.
+func (h *Hub) Start() {
+	listener := pq.NewListener(h.dsn, time.Second, time.Minute, h.connectionEvent)
+	go func() {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("Warning: failed to listen for story events: %v", err)
+			return
+		}
+
+		ping := time.NewTicker(time.Minute)
+		defer ping.Stop()
+
+		for {
+			select {
+			case n := <-listener.Notify:
+				// nil after a reconnect
+				if n != nil {
+					h.dispatch(n.Extra)
+				}
+			case <-ping.C:
+				go listener.Ping()
+			}
+		}
+	}()
+}
+
+func (h *Hub) connectionEvent(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventDisconnected:
+		log.Printf("Warning: story event listener disconnected: %v", err)
+	case pq.ListenerEventReconnected:
+		h.broadcast(Event{Type: TypeResync})
+	}
+}
+
+func (h *Hub) dispatch(payload string) {
+	var ev struct {
+		Event
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		log.Printf("Warning: invalid story event %q: %v", payload, err)
+		return
+	}
+	ev.Event.UserID = ev.UserID
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[ev.UserID] {
+		h.send(ev.UserID, ch, ev.Event)
+	}
+}
+
+func (h *Hub) broadcast(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, chans := range h.subs {
+		for ch := range chans {
+			h.send(userID, ch, ev)
+		}
+	}
+}
+
+// send must be called with h.mu held. Subscribers that cannot keep up are
+// dropped and their channel closed.
+func (h *Hub) send(userID string, ch chan Event, ev Event) {
+	select {
+	case ch <- ev:
+	default:
+		h.remove(userID, ch)
+	}
+}
+
+func (h *Hub) remove(userID string, ch chan Event) {
+	if _, ok := h.subs[userID][ch]; !ok {
+		return
+	}
+	delete(h.subs[userID], ch)
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+	close(ch)
+}
+
+// Subscribe returns the events for a user's stories. The channel is closed
+// when cancel is called or the subscriber falls behind.
+func (h *Hub) Subscribe(userID string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan Event]struct{}{}
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		h.remove(userID, ch)
+		h.mu.Unlock()
+	}
+	return ch, cancel
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type AdminHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	denylist *middleware.TokenDenylist
+	guard    *middleware.LoginGuard
+	pinGuard *middleware.LoginGuard
+	mfa      *middleware.MFAPolicy
+	audit    *audit.Recorder
+}
+
+func NewAdminHandler(db *sql.DB, cfg *config.Config, denylist *middleware.TokenDenylist, guard, pinGuard *middleware.LoginGuard, mfa *middleware.MFAPolicy, rec *audit.Recorder) *AdminHandler {
+	return &AdminHandler{db: db, cfg: cfg, denylist: denylist, guard: guard, pinGuard: pinGuard, mfa: mfa, audit: rec}
+}
+
+func (h *AdminHandler) UpdateUserRole(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	targetID := c.Params("id")
+
+	var req models.UpdateRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !middleware.ValidRole(req.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be one of 'student', 'parent', 'teacher', 'admin'",
+		})
+	}
+
+	if targetID == adminID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot change your own role",
+		})
+	}
+
+	if !h.userExists(targetID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, req.Role, targetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+
+	// Tokens carrying the old role must not keep working; the user's
+	// sessions pick up the new role on their next refresh
+	h.denylist.DenyUser(targetID)
+
+	h.audit.Request(c, audit.RoleChanged, audit.TargetUser, targetID, map[string]interface{}{
+		"role": req.Role,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Role updated",
+		"role":    req.Role,
+	})
+}
+
+func (h *AdminHandler) BanUser(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	targetID := c.Params("id")
+
+	if targetID == adminID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot ban yourself",
+		})
+	}
+
+	if !h.userExists(targetID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE users SET banned_at = COALESCE(banned_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, targetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to ban user",
+		})
+	}
+
+	if _, err := revokeSessions(h.db, h.denylist, targetID, ""); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	h.denylist.DenyUser(targetID)
+
+	h.audit.Request(c, audit.UserBanned, audit.TargetUser, targetID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "User banned",
+	})
+}
+
+func (h *AdminHandler) UnbanUser(c *fiber.Ctx) error {
+	targetID := c.Params("id")
+
+	if !h.userExists(targetID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE users SET banned_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1
+	`, targetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unban user",
+		})
+	}
+
+	h.audit.Request(c, audit.UserUnbanned, audit.TargetUser, targetID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "User unbanned",
+	})
+}
+
+// UnlockUser lifts a login lockout before it expires on its own.
+func (h *AdminHandler) UnlockUser(c *fiber.Ctx) error {
+	targetID := c.Params("id")
+
+	if !h.userExists(targetID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	var email, username, loginCode string
+	err := h.db.QueryRow(`
+		SELECT COALESCE(email, ''), COALESCE(username, ''), COALESCE(login_code, '')
+		FROM users WHERE id = $1
+	`, targetID).Scan(&email, &username, &loginCode)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if email != "" {
+		if err := h.guard.Unlock(email); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to unlock user",
+			})
+		}
+	}
+	if err := unlockPIN(h.pinGuard, username, loginCode); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlock user",
+		})
+	}
+
+	h.audit.Request(c, audit.UserUnlocked, audit.TargetUser, targetID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "User unlocked",
+	})
+}
+
+// ResetUserMFA removes a user's 2FA, e.g. after losing both the device and
+// the recovery codes. The user is signed out everywhere and has to set it up
+// again if their role requires it.
+func (h *AdminHandler) ResetUserMFA(c *fiber.Ctx) error {
+	targetID := c.Params("id")
+
+	if !h.userExists(targetID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := disableMFA(h.db, targetID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset two-factor authentication",
+		})
+	}
+
+	if _, err := revokeSessions(h.db, h.denylist, targetID, ""); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	h.audit.Request(c, audit.MFAReset, audit.TargetUser, targetID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication reset",
+	})
+}
+
+func (h *AdminHandler) GetMFAPolicies(c *fiber.Ctx) error {
+	rows, err := h.db.Query("SELECT role, required, updated_at FROM mfa_role_policies ORDER BY role")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch policies",
+		})
+	}
+	defer rows.Close()
+
+	policies := []models.MFARolePolicy{}
+	for rows.Next() {
+		var p models.MFARolePolicy
+		if err := rows.Scan(&p.Role, &p.Required, &p.UpdatedAt); err != nil {
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	return c.JSON(fiber.Map{
+		"policies": policies,
+	})
+}
+
+// UpdateMFAPolicy makes 2FA mandatory (or optional) for a role. Users of that
+// role who have not enrolled are limited to 2FA setup until they do.
+func (h *AdminHandler) UpdateMFAPolicy(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	role := c.Params("role")
+
+	var req models.UpdateMFAPolicyRequest
+	if err := c.BodyParser(&req); err != nil || req.Required == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "required (true or false) is required",
+		})
+	}
+
+	var p models.MFARolePolicy
+	err := h.db.QueryRow(`
+		UPDATE mfa_role_policies SET required = $1, updated_by = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE role = $3
+		RETURNING role, required, updated_at
+	`, *req.Required, adminID, role).Scan(&p.Role, &p.Required, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Role must be one of 'parent', 'teacher', 'admin'",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update policy",
+		})
+	}
+
+	h.mfa.Invalidate()
+
+	h.audit.Request(c, audit.MFAPolicyChanged, audit.TargetRole, "", map[string]interface{}{
+		"role":     p.Role,
+		"required": p.Required,
+	})
+
+	return c.JSON(p)
+}
+
+func (h *AdminHandler) userExists(userID string) bool {
+	if _, err := uuid.Parse(userID); err != nil {
+		return false
+	}
+
+	var exists bool
+	h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+	return exists
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// AuditHandler lets admins search the security audit log. Events are
+// written by audit.Recorder and can never be changed or removed.
+type AuditHandler struct {
+	db *sql.DB
+}
+
+func NewAuditHandler(db *sql.DB) *AuditHandler {
+	return &AuditHandler{db: db}
+}
+
+// GetEvents lists audit events, newest first. Filters: actor_id, target_id,
+// type (comma separated, "auth.*" matches a whole area), from and to
+// (RFC 3339). Page with limit and before, the next_before of the previous
+// page.
+func (h *AuditHandler) GetEvents(c *fiber.Ctx) error {
+	query := `
+		SELECT id, event_type, actor_id, actor_role, target_id, target_type,
+		       session_id, ip_address, user_agent, metadata, occurred_at
+		FROM audit_events WHERE TRUE`
+	args := []interface{}{}
+	argCount := 0
+
+	for _, f := range []struct{ param, column string }{
+		{"actor_id", "actor_id"},
+		{"target_id", "target_id"},
+	} {
+		v := c.Query(f.param)
+		if v == "" {
+			continue
+		}
+		if _, err := uuid.Parse(v); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("%s must be a UUID", f.param),
+			})
+		}
+		argCount++
+		query += fmt.Sprintf(" AND %s = $%d", f.column, argCount)
+		args = append(args, v)
+	}
+
+	if types := c.Query("type"); types != "" {
+		conds := []string{}
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			argCount++
+			if strings.HasSuffix(t, "*") {
+				// Escape LIKE wildcards so only the trailing * is a pattern
+				prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimSuffix(t, "*"))
+				conds = append(conds, fmt.Sprintf("event_type LIKE $%d", argCount))
+				args = append(args, prefix+"%")
+			} else {
+				conds = append(conds, fmt.Sprintf("event_type = $%d", argCount))
+				args = append(args, t)
+			}
+		}
+		if len(conds) > 0 {
+			query += " AND (" + strings.Join(conds, " OR ") + ")"
+		}
+	}
+
+	for _, f := range []struct{ param, op string }{
+		{"from", ">="},
+		{"to", "<"},
+	} {
+		v := c.Query(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("%s must be an RFC 3339 timestamp", f.param),
+			})
+		}
+		// occurred_at is a TIMESTAMP in UTC; Postgres would drop the offset
+		argCount++
+		query += fmt.Sprintf(" AND occurred_at %s $%d", f.op, argCount)
+		args = append(args, t.UTC())
+	}
+
+	if v := c.Query("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "before must be an event ID",
+			})
+		}
+		argCount++
+		query += fmt.Sprintf(" AND id < $%d", argCount)
+		args = append(args, before)
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+	argCount++
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch audit events",
+		})
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		var metadata []byte
+		if err := rows.Scan(
+			&e.ID, &e.EventType, &e.ActorID, &e.ActorRole, &e.TargetID, &e.TargetType,
+			&e.SessionID, &e.IPAddress, &e.UserAgent, &metadata, &e.OccurredAt,
+		); err != nil {
+			continue
+		}
+		e.Metadata = metadata
+		events = append(events, e)
+	}
+
+	resp := models.AuditEventListResponse{Events: events}
+	if len(events) == limit {
+		resp.NextBefore = &events[len(events)-1].ID
+	}
+
+	return c.JSON(resp)
+}
@@ -2,9 +2,16 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gili/backend/audit"
 	"github.com/gili/backend/config"
+	"github.com/gili/backend/mailer"
 	"github.com/gili/backend/middleware"
 	"github.com/gili/backend/models"
 	"github.com/gofiber/fiber/v2"
@@ -13,12 +20,19 @@ import (
 )
 
 type AuthHandler struct {
-	db  *sql.DB
-	cfg *config.Config
+	db       *sql.DB
+	cfg      *config.Config
+	keys     *middleware.KeyManager
+	denylist *middleware.TokenDenylist
+	guard    *middleware.LoginGuard
+	pinGuard *middleware.LoginGuard
+	mailer   mailer.Mailer
+	mfa      *middleware.MFAPolicy
+	audit    *audit.Recorder
 }
 
-func NewAuthHandler(db *sql.DB, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{db: db, cfg: cfg}
+func NewAuthHandler(db *sql.DB, cfg *config.Config, keys *middleware.KeyManager, denylist *middleware.TokenDenylist, guard, pinGuard *middleware.LoginGuard, mail mailer.Mailer, mfa *middleware.MFAPolicy, rec *audit.Recorder) *AuthHandler {
+	return &AuthHandler{db: db, cfg: cfg, keys: keys, denylist: denylist, guard: guard, pinGuard: pinGuard, mailer: mail, mfa: mfa, audit: rec}
 }
 
 func (h *AuthHandler) Register(c *fiber.Ctx) error {
@@ -70,12 +84,27 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		level = "sd"
 	}
 
+	// Only student and parent accounts can sign up themselves; teachers and
+	// admins are promoted by an admin
+	role := req.Role
+	if role == "" {
+		role = middleware.RoleStudent
+	}
+	if role != middleware.RoleStudent && role != middleware.RoleParent {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be 'student' or 'parent'",
+		})
+	}
+
+	// Young users stay restricted until a guardian consents
+	consentStatus := middleware.ConsentStatusForAge(req.Age, role, h.cfg.ConsentAgeThreshold)
+
 	// Create user
 	userID := uuid.New().String()
 	_, err = h.db.Exec(`
-		INSERT INTO users (id, name, email, password_hash, age, level)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, userID, req.Name, req.Email, string(hashedPassword), req.Age, level)
+		INSERT INTO users (id, name, email, password_hash, age, level, role, consent_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, userID, req.Name, req.Email, string(hashedPassword), req.Age, level, role, consentStatus)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -84,36 +113,36 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 	}
 
 	// Initialize skill progress for new user
-	h.initializeSkillProgress(userID)
+	initializeSkillProgress(h.db, userID)
 
-	// Generate tokens
-	accessToken, refreshToken, err := middleware.GenerateTokens(userID, req.Email, h.cfg)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate tokens",
-		})
+	// Ask the user to confirm their email address
+	if err := h.sendVerificationEmail(userID, req.Email, req.Name); err != nil {
+		log.Printf("Failed to create email verification for user %s: %v", userID, err)
 	}
 
-	// Store refresh token
-	h.storeRefreshToken(userID, refreshToken)
-
 	user := &models.User{
-		ID:        userID,
-		Name:      req.Name,
-		Email:     req.Email,
-		Age:       req.Age,
-		Level:     level,
-		Avatar:    "😊",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:            userID,
+		Name:          req.Name,
+		Email:         req.Email,
+		Age:           req.Age,
+		Level:         level,
+		Avatar:        "😊",
+		Role:          role,
+		ConsentStatus: consentStatus,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(models.AuthResponse{
-		User:         user,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    int64(h.cfg.JWTExpiry.Seconds()),
-	})
+	h.audit.RequestBy(c, userID, role, "", audit.UserRegistered, audit.TargetUser, userID, nil)
+
+	resp, err := h.startSession(c, user, req.DeviceInfo, "password")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start session",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(resp)
 }
 
 func (h *AuthHandler) Login(c *fiber.Ctx) error {
@@ -130,17 +159,17 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get user
-	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, name, email, password_hash, age, level, avatar, created_at, updated_at
-		FROM users WHERE email = $1
-	`, req.Email).Scan(
-		&user.ID, &user.Name, &user.Email, &user.PasswordHash,
-		&user.Age, &user.Level, &user.Avatar, &user.CreatedAt, &user.UpdatedAt,
-	)
+	if wait, locked := h.guard.Claim(req.Email, c.IP()); wait > 0 {
+		return tooManyLoginAttempts(c, wait, locked)
+	}
 
+	// Get user
+	user, err := h.findLoginUser("email", req.Email)
 	if err == sql.ErrNoRows {
+		// The typed email is personal data and is not kept
+		h.audit.RequestBy(c, "", "", "", audit.LoginFailed, "", "", map[string]interface{}{
+			"reason": "unknown_account",
+		})
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid email or password",
 		})
@@ -153,28 +182,243 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		h.audit.RequestBy(c, "", "", "", audit.LoginFailed, audit.TargetUser, user.ID, map[string]interface{}{
+			"reason": "bad_password",
+		})
+		if wait, locked := h.guard.RecordFailure(req.Email, c.IP()); locked {
+			h.audit.RequestBy(c, "", "", "", audit.LoginLocked, audit.TargetUser, user.ID, nil)
+			return tooManyLoginAttempts(c, wait, locked)
+		}
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid email or password",
 		})
 	}
 
-	// Generate tokens
-	accessToken, refreshToken, err := middleware.GenerateTokens(user.ID, user.Email, h.cfg)
+	if user.banned {
+		h.guard.Release(req.Email, c.IP())
+		h.audit.RequestBy(c, "", "", "", audit.LoginFailed, audit.TargetUser, user.ID, map[string]interface{}{
+			"reason": "banned",
+		})
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This account has been suspended",
+		})
+	}
+
+	// With 2FA the failure counter is only reset once the second factor is
+	// verified, so that codes cannot be guessed by logging in again
+	if user.mfaEnabled {
+		h.guard.Release(req.Email, c.IP())
+		return h.startMFAChallenge(c, &user.User, req.DeviceInfo)
+	}
+
+	h.guard.RecordSuccess(req.Email, c.IP())
+
+	resp, err := h.startSession(c, &user.User, req.DeviceInfo, "password")
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate tokens",
+			"error": "Failed to start session",
 		})
 	}
 
-	// Store refresh token
-	h.storeRefreshToken(user.ID, refreshToken)
+	return c.JSON(resp)
+}
 
-	return c.JSON(models.AuthResponse{
-		User:         &user,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    int64(h.cfg.JWTExpiry.Seconds()),
-	})
+// VerifyMFA completes a login started by Login for an account with 2FA,
+// using a TOTP code or a recovery code.
+func (h *AuthHandler) VerifyMFA(c *fiber.Ctx) error {
+	var req models.VerifyMFARequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "MFA token and a code or recovery code are required",
+		})
+	}
+
+	var challengeID, userID string
+	var device models.DeviceInfo
+	var deviceName, platform, appVersion sql.NullString
+	// Each request claims an attempt up front, so that parallel guesses
+	// cannot get past the limit
+	err := h.db.QueryRow(`
+		UPDATE mfa_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP AND attempts < $2
+		RETURNING id, user_id, device_name, platform, app_version
+	`, middleware.HashToken(req.MFAToken), h.cfg.MFAChallengeMaxAttempts).Scan(&challengeID, &userID, &deviceName, &platform, &appVersion)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Login expired, please sign in again",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	device.DeviceName, device.Platform, device.AppVersion = deviceName.String, platform.String, appVersion.String
+
+	user, err := h.findLoginUser("id", userID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Login expired, please sign in again",
+		})
+	}
+
+	if wait, locked := h.guard.Claim(user.Email, c.IP()); wait > 0 {
+		return tooManyLoginAttempts(c, wait, locked)
+	}
+
+	var ok bool
+	method := "password+totp"
+	if req.Code != "" {
+		ok, err = verifyTOTP(h.db, h.cfg, userID, req.Code, true)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+	} else {
+		method = "password+recovery_code"
+		ok = useRecoveryCode(h.db, userID, req.RecoveryCode)
+	}
+
+	if !ok {
+		h.audit.RequestBy(c, "", "", "", audit.MFAChallengeFailed, audit.TargetUser, userID, map[string]interface{}{
+			"method": method,
+		})
+		if wait, locked := h.guard.RecordFailure(user.Email, c.IP()); locked {
+			h.audit.RequestBy(c, "", "", "", audit.LoginLocked, audit.TargetUser, userID, nil)
+			return tooManyLoginAttempts(c, wait, locked)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE mfa_challenges SET used_at = CURRENT_TIMESTAMP WHERE id = $1 AND used_at IS NULL
+	`, challengeID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Login expired, please sign in again",
+		})
+	}
+
+	if user.banned {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This account has been suspended",
+		})
+	}
+
+	h.guard.RecordSuccess(user.Email, c.IP())
+
+	if req.Code == "" {
+		h.audit.RequestBy(c, userID, user.Role, "", audit.RecoveryCodeUsed, audit.TargetUser, userID, nil)
+	}
+
+	resp, err := h.startSession(c, &user.User, device, method)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start session",
+		})
+	}
+
+	return c.JSON(resp)
+}
+
+// ChildLogin signs in a managed child account with a username or login code
+// and a PIN.
+func (h *AuthHandler) ChildLogin(c *fiber.Ctx) error {
+	var req models.ChildLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	req.LoginCode = strings.ToUpper(strings.TrimSpace(req.LoginCode))
+	if (req.Username == "" && req.LoginCode == "") || req.PIN == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username or login code, and PIN are required",
+		})
+	}
+
+	account := pinAccount(req.Username, req.LoginCode)
+	if wait, locked := h.pinGuard.Claim(account, c.IP()); wait > 0 {
+		return tooManyLoginAttempts(c, wait, locked)
+	}
+
+	query := `
+		SELECT id, name, username, COALESCE(pin_hash, ''), age, level, avatar, role, consent_status,
+		       banned_at, created_at, updated_at
+		FROM users WHERE username = $1
+	`
+	identifier := req.Username
+	if req.Username == "" {
+		query = strings.Replace(query, "username = $1", "login_code = $1", 1)
+		identifier = req.LoginCode
+	}
+
+	var user models.User
+	var pinHash string
+	var bannedAt sql.NullTime
+	err := h.db.QueryRow(query, identifier).Scan(
+		&user.ID, &user.Name, &user.Username, &pinHash, &user.Age, &user.Level,
+		&user.Avatar, &user.Role, &user.ConsentStatus, &bannedAt, &user.CreatedAt, &user.UpdatedAt,
+	)
+
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err == sql.ErrNoRows || pinHash == "" || bcrypt.CompareHashAndPassword([]byte(pinHash), []byte(req.PIN)) != nil {
+		h.audit.RequestBy(c, "", "", "", audit.LoginFailed, audit.TargetUser, user.ID, map[string]interface{}{
+			"account": account,
+			"reason":  "bad_pin",
+		})
+		if wait, locked := h.pinGuard.RecordFailure(account, c.IP()); locked {
+			h.audit.RequestBy(c, "", "", "", audit.LoginLocked, audit.TargetUser, user.ID, map[string]interface{}{
+				"account": account,
+			})
+			return tooManyLoginAttempts(c, wait, locked)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid username or PIN",
+		})
+	}
+
+	if bannedAt.Valid {
+		h.pinGuard.Release(account, c.IP())
+		h.audit.RequestBy(c, "", "", "", audit.LoginFailed, audit.TargetUser, user.ID, map[string]interface{}{
+			"reason": "banned",
+		})
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This account has been suspended",
+		})
+	}
+
+	h.pinGuard.RecordSuccess(account, c.IP())
+
+	resp, err := h.startSession(c, &user, req.DeviceInfo, "pin")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start session",
+		})
+	}
+
+	return c.JSON(resp)
 }
 
 func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
@@ -185,23 +429,45 @@ func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	claims, err := middleware.ValidateRefreshToken(req.RefreshToken, h.cfg, h.db)
+	claims, err := middleware.ValidateRefreshToken(req.RefreshToken, h.keys, h.db)
+	if errors.Is(err, middleware.ErrRefreshTokenReused) {
+		log.Printf("Warning: refresh token reuse for user %s, family %s revoked", claims.UserID, claims.FamilyID)
+		h.audit.RequestBy(c, "", "", claims.FamilyID, audit.RefreshTokenReused, audit.TargetUser, claims.UserID, nil)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token has already been used, please log in again",
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid refresh token",
 		})
 	}
 
-	// Generate new tokens
-	accessToken, refreshToken, err := middleware.GenerateTokens(claims.UserID, claims.Email, h.cfg)
+	// Generate new tokens in the same family
+	accessToken, refreshToken, err := middleware.GenerateTokens(claims.UserID, claims.Email, claims.Role, claims.FamilyID, h.cfg, h.keys)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate tokens",
 		})
 	}
 
-	// Store new refresh token
-	h.storeRefreshToken(claims.UserID, refreshToken)
+	// Replace the presented refresh token with the new one
+	err = h.rotateRefreshToken(req.RefreshToken, refreshToken, claims)
+	if errors.Is(err, middleware.ErrRefreshTokenReused) {
+		log.Printf("Warning: concurrent refresh token reuse for user %s, family %s revoked", claims.UserID, claims.FamilyID)
+		h.audit.RequestBy(c, "", "", claims.FamilyID, audit.RefreshTokenReused, audit.TargetUser, claims.UserID, nil)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token has already been used, please log in again",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate refresh token",
+		})
+	}
+
+	touchSession(h.db, claims.FamilyID, c.IP())
+	h.audit.RequestBy(c, claims.UserID, claims.Role, claims.FamilyID, audit.TokenRefreshed, audit.TargetSession, claims.FamilyID, nil)
 
 	return c.JSON(fiber.Map{
 		"access_token":  accessToken,
@@ -212,26 +478,208 @@ func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 
 func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+	claims := c.Locals("claims").(*middleware.Claims)
+
+	// Stop the presented access token from being used again
+	if claims.ExpiresAt != nil {
+		h.denylist.DenyToken(claims.ID, claims.ExpiresAt.Time)
+	}
 
-	// Delete all refresh tokens for user
-	h.db.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", userID)
+	// Revoke the current session. Tokens issued before sessions existed carry
+	// no session ID, so fall back to signing out everywhere. Rows are kept so
+	// that a stolen refresh token presented later is still rejected.
+	if sessionID != "" {
+		h.db.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		`, sessionID, userID)
+		middleware.RevokeTokenFamily(h.db, sessionID)
+		h.denylist.DenySession(sessionID)
+	} else {
+		revokeSessions(h.db, h.denylist, userID, "")
+		h.denylist.DenyUser(userID)
+	}
+
+	h.audit.Request(c, audit.Logout, audit.TargetSession, sessionID, nil)
 
 	return c.JSON(fiber.Map{
 		"message": "Logged out successfully",
 	})
 }
 
-func (h *AuthHandler) storeRefreshToken(userID, token string) {
+// startSession records a new session for user and issues its first token
+// pair. The session ID is the refresh token family. method describes how the
+// user authenticated, for the audit log.
+func (h *AuthHandler) startSession(c *fiber.Ctx, user *models.User, device models.DeviceInfo, method string) (*models.AuthResponse, error) {
+	familyID, err := createSession(h.db, user.ID, device, c.IP())
+	if err != nil {
+		return nil, err
+	}
+
+	h.audit.RequestBy(c, user.ID, user.Role, familyID, audit.LoginSucceeded, audit.TargetSession, familyID, map[string]interface{}{
+		"method": method,
+	})
+
+	accessToken, refreshToken, err := middleware.GenerateTokens(user.ID, user.Email, user.Role, familyID, h.cfg, h.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := h.storeRefreshToken(h.db, user.ID, familyID, refreshToken); err != nil {
+		return nil, err
+	}
+
+	resp := &models.AuthResponse{
+		User:         user,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(h.cfg.JWTExpiry.Seconds()),
+	}
+
+	// Tell the app to send the user to 2FA setup before anything else
+	if h.mfa.Required(user.Role) {
+		var enrolled bool
+		h.db.QueryRow("SELECT mfa_enabled_at IS NOT NULL FROM users WHERE id = $1", user.ID).Scan(&enrolled)
+		resp.MFAEnrollmentRequired = !enrolled
+	}
+
+	return resp, nil
+}
+
+// loginUser is a user row as needed by the login flows.
+type loginUser struct {
+	models.User
+	banned     bool
+	mfaEnabled bool
+}
+
+// findLoginUser loads the user whose column ("email" or "id") equals value.
+func (h *AuthHandler) findLoginUser(column, value string) (*loginUser, error) {
+	var u loginUser
+	var bannedAt, mfaEnabledAt sql.NullTime
+	err := h.db.QueryRow(`
+		SELECT id, name, COALESCE(email, ''), COALESCE(password_hash, ''), age, level, avatar, role, consent_status,
+		       email_verified_at, banned_at, mfa_enabled_at, created_at, updated_at
+		FROM users WHERE `+column+` = $1
+	`, value).Scan(
+		&u.ID, &u.Name, &u.Email, &u.PasswordHash,
+		&u.Age, &u.Level, &u.Avatar, &u.Role, &u.ConsentStatus, &u.EmailVerifiedAt, &bannedAt, &mfaEnabledAt,
+		&u.CreatedAt, &u.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	u.banned = bannedAt.Valid
+	u.mfaEnabled = mfaEnabledAt.Valid
+	return &u, nil
+}
+
+// startMFAChallenge answers a correct password for an account with 2FA with a
+// short-lived token to be exchanged, together with a code, at VerifyMFA.
+func (h *AuthHandler) startMFAChallenge(c *fiber.Ctx, user *models.User, device models.DeviceInfo) error {
+	token, err := generateToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO mfa_challenges (user_id, token_hash, device_name, platform, app_version, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, user.ID, middleware.HashToken(token),
+		nullString(truncate(device.DeviceName, 100)),
+		nullString(truncate(device.Platform, 20)),
+		nullString(truncate(device.AppVersion, 50)),
+		time.Now().Add(h.cfg.MFAChallengeExpiry))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+
+	return c.JSON(models.MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(h.cfg.MFAChallengeExpiry.Seconds()),
+	})
+}
+
+// tooManyLoginAttempts tells the client how long to wait before the next
+// login attempt.
+func tooManyLoginAttempts(c *fiber.Ctx, wait time.Duration, locked bool) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+
+	message := "Too many failed login attempts, please wait before trying again"
+	if locked {
+		message = "Account temporarily locked after too many failed login attempts"
+	}
+
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":       message,
+		"locked":      locked,
+		"retry_after": seconds,
+	})
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// storeRefreshToken persists the SHA-256 hash of a refresh token and returns
+// the new row ID.
+func (h *AuthHandler) storeRefreshToken(db execer, userID, familyID, token string) (string, error) {
+	id := uuid.New().String()
 	expiresAt := time.Now().Add(h.cfg.JWTRefreshExpiry)
-	h.db.Exec(`
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)
-	`, userID, token, expiresAt)
+	_, err := db.Exec(`
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, id, userID, familyID, middleware.HashToken(token), expiresAt)
+	return id, err
+}
+
+// rotateRefreshToken stores newToken and marks oldToken as replaced by it.
+// If oldToken was revoked in the meantime (two clients racing with the same
+// token) the family is revoked and ErrRefreshTokenReused is returned.
+func (h *AuthHandler) rotateRefreshToken(oldToken, newToken string, claims *middleware.Claims) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	newID, err := h.storeRefreshToken(tx, claims.UserID, claims.FamilyID, newToken)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP, replaced_by = $1
+		WHERE token_hash = $2 AND revoked_at IS NULL
+	`, newID, middleware.HashToken(oldToken))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		if err := middleware.RevokeTokenFamily(h.db, claims.FamilyID); err != nil {
+			return err
+		}
+		return middleware.ErrRefreshTokenReused
+	}
+
+	return tx.Commit()
 }
 
-func (h *AuthHandler) initializeSkillProgress(userID string) {
+func initializeSkillProgress(db *sql.DB, userID string) {
 	// Get all skills and create progress entries
-	rows, err := h.db.Query("SELECT id FROM skills")
+	rows, err := db.Query("SELECT id FROM skills")
 	if err != nil {
 		return
 	}
@@ -242,7 +690,7 @@ func (h *AuthHandler) initializeSkillProgress(userID string) {
 		if err := rows.Scan(&skillID); err != nil {
 			continue
 		}
-		h.db.Exec(`
+		db.Exec(`
 			INSERT INTO skill_progress (user_id, skill_id, level, progress, total_stories)
 			VALUES ($1, $2, 1, 0, 0)
 			ON CONFLICT (user_id, skill_id) DO NOTHING
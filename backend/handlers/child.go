@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._]{2,29}$`)
+	pinPattern      = regexp.MustCompile(`^[0-9]{4,6}$`)
+)
+
+// loginCodeAlphabet leaves out characters children confuse (0/O, 1/I/L).
+const loginCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// ChildHandler lets parents and teachers manage child accounts that sign in
+// with a username or login code and a PIN instead of email and password.
+type ChildHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	denylist *middleware.TokenDenylist
+	pinGuard *middleware.LoginGuard
+	audit    *audit.Recorder
+}
+
+func NewChildHandler(db *sql.DB, cfg *config.Config, denylist *middleware.TokenDenylist, pinGuard *middleware.LoginGuard, rec *audit.Recorder) *ChildHandler {
+	return &ChildHandler{db: db, cfg: cfg, denylist: denylist, pinGuard: pinGuard, audit: rec}
+}
+
+func (h *ChildHandler) CreateChild(c *fiber.Ctx) error {
+	guardianID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+
+	var req models.CreateChildRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if len(req.Name) < 2 || !usernamePattern.MatchString(req.Username) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name and a username of 3-30 lowercase letters, digits, '.' or '_' are required",
+		})
+	}
+
+	if msg := validatePIN(req.PIN); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	var exists bool
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", req.Username).Scan(&exists)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if exists {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username already taken",
+		})
+	}
+
+	pinHash, err := bcrypt.GenerateFromPassword([]byte(req.PIN), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash PIN",
+		})
+	}
+
+	loginCode, err := generateLoginCode(8)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate login code",
+		})
+	}
+
+	level := req.Level
+	if level == "" {
+		level = "sd"
+	}
+	avatar := req.Avatar
+	if avatar == "" {
+		avatar = "😊"
+	}
+
+	// A parent with a verified email may consent to the current policy while
+	// creating the account; accounts created by teachers still need a
+	// parent's consent
+	consentStatus := middleware.ConsentStatusForAge(req.Age, middleware.RoleStudent, h.cfg.ConsentAgeThreshold)
+	guardianConsents := false
+	if consentStatus == middleware.ConsentPending && role == middleware.RoleParent &&
+		req.ConsentPolicyVersion == h.cfg.ConsentPolicyVersion {
+		h.db.QueryRow(`
+			SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1
+		`, guardianID).Scan(&guardianConsents)
+		if guardianConsents {
+			consentStatus = middleware.ConsentGranted
+		}
+	}
+
+	childID := uuid.New().String()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO users (id, name, username, login_code, pin_hash, age, level, avatar, role, consent_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, childID, req.Name, req.Username, loginCode, string(pinHash), req.Age, level, avatar,
+		middleware.RoleStudent, consentStatus)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create child account",
+		})
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO guardianships (guardian_id, child_id, relationship, status)
+		VALUES ($1, $2, $3, 'active')
+	`, guardianID, childID, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link child account",
+		})
+	}
+
+	if guardianConsents {
+		_, err = tx.Exec(`
+			INSERT INTO consent_records (child_id, guardian_id, method, policy_version, ip_address)
+			VALUES ($1, $2, 'account_created_by_guardian', $3, $4)
+		`, childID, guardianID, h.cfg.ConsentPolicyVersion, truncate(c.IP(), 45))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to record consent",
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create child account",
+		})
+	}
+
+	initializeSkillProgress(h.db, childID)
+
+	h.audit.Request(c, audit.ChildCreated, audit.TargetUser, childID, nil)
+	if guardianConsents {
+		h.audit.Request(c, audit.ConsentGranted, audit.TargetUser, childID, map[string]interface{}{
+			"method": "account_created_by_guardian",
+		})
+	}
+
+	child, err := h.getChild(guardianID, childID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(child)
+}
+
+func (h *ChildHandler) GetChildren(c *fiber.Ctx) error {
+	guardianID := c.Locals("userID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT u.id, u.name, COALESCE(u.username, ''), COALESCE(u.login_code, ''), u.age, u.level, u.avatar,
+		       g.relationship, u.created_at
+		FROM guardianships g
+		JOIN users u ON u.id = g.child_id
+		WHERE g.guardian_id = $1 AND g.status = 'active'
+		ORDER BY u.name
+	`, guardianID)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch children",
+		})
+	}
+	defer rows.Close()
+
+	children := []models.Child{}
+	for rows.Next() {
+		var child models.Child
+		err := rows.Scan(
+			&child.ID, &child.Name, &child.Username, &child.LoginCode, &child.Age,
+			&child.Level, &child.Avatar, &child.Relationship, &child.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		children = append(children, child)
+	}
+
+	return c.JSON(models.ChildListResponse{
+		Children:   children,
+		TotalCount: len(children),
+	})
+}
+
+// ResetPIN sets a new PIN for a linked child, signs the child out everywhere
+// and lifts any PIN lockout.
+func (h *ChildHandler) ResetPIN(c *fiber.Ctx) error {
+	guardianID := c.Locals("userID").(string)
+	childID := c.Params("id")
+
+	if !middleware.IsGuardianOf(h.db, guardianID, childID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Child not found",
+		})
+	}
+
+	var req models.ResetPINRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if msg := validatePIN(req.PIN); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	pinHash, err := bcrypt.GenerateFromPassword([]byte(req.PIN), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash PIN",
+		})
+	}
+
+	var username, loginCode string
+	err = h.db.QueryRow(`
+		UPDATE users SET pin_hash = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND pin_hash IS NOT NULL
+		RETURNING COALESCE(username, ''), COALESCE(login_code, '')
+	`, string(pinHash), childID).Scan(&username, &loginCode)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This account does not sign in with a PIN",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset PIN",
+		})
+	}
+
+	if _, err := revokeSessions(h.db, h.denylist, childID, ""); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	h.denylist.DenyUser(childID)
+	unlockPIN(h.pinGuard, username, loginCode)
+
+	h.audit.Request(c, audit.PINReset, audit.TargetUser, childID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "PIN has been reset",
+	})
+}
+
+func (h *ChildHandler) getChild(guardianID, childID string) (*models.Child, error) {
+	var child models.Child
+	err := h.db.QueryRow(`
+		SELECT u.id, u.name, COALESCE(u.username, ''), COALESCE(u.login_code, ''), u.age, u.level, u.avatar,
+		       g.relationship, u.created_at
+		FROM guardianships g
+		JOIN users u ON u.id = g.child_id
+		WHERE g.guardian_id = $1 AND g.child_id = $2
+	`, guardianID, childID).Scan(
+		&child.ID, &child.Name, &child.Username, &child.LoginCode, &child.Age,
+		&child.Level, &child.Avatar, &child.Relationship, &child.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &child, nil
+}
+
+// validatePIN returns an error message for PINs that are malformed or
+// trivially guessable, or "" if the PIN is acceptable.
+func validatePIN(pin string) string {
+	if !pinPattern.MatchString(pin) {
+		return "PIN must be 4-6 digits"
+	}
+
+	same, ascending, descending := true, true, true
+	for i := 1; i < len(pin); i++ {
+		if pin[i] != pin[0] {
+			same = false
+		}
+		if pin[i] != pin[i-1]+1 {
+			ascending = false
+		}
+		if pin[i] != pin[i-1]-1 {
+			descending = false
+		}
+	}
+	if same || ascending || descending {
+		return "PIN is too easy to guess"
+	}
+	return ""
+}
+
+// pinAccount returns the key under which failed PIN attempts are counted.
+func pinAccount(username, loginCode string) string {
+	if username != "" {
+		return "username:" + strings.ToLower(username)
+	}
+	return "code:" + strings.ToUpper(loginCode)
+}
+
+func unlockPIN(guard *middleware.LoginGuard, username, loginCode string) error {
+	if username != "" {
+		if err := guard.Unlock(pinAccount(username, "")); err != nil {
+			return err
+		}
+	}
+	if loginCode != "" {
+		if err := guard.Unlock(pinAccount("", loginCode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateLoginCode returns a random code that is easy to read off a card.
+func generateLoginCode(length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(loginCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = loginCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/mailer"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ConsentHandler records a guardian's consent for users younger than
+// cfg.ConsentAgeThreshold. A guardian consents either from a linked parent
+// account with a verified email, or through a link emailed to that account's
+// verified address. Links the child approved themselves count for neither
+// until a school admin approves them.
+type ConsentHandler struct {
+	db     *sql.DB
+	cfg    *config.Config
+	mailer mailer.Mailer
+	audit  *audit.Recorder
+}
+
+func NewConsentHandler(db *sql.DB, cfg *config.Config, mail mailer.Mailer, rec *audit.Recorder) *ConsentHandler {
+	return &ConsentHandler{db: db, cfg: cfg, mailer: mail, audit: rec}
+}
+
+func (h *ConsentHandler) GetConsent(c *fiber.Ctx) error {
+	userID := middleware.SubjectUserID(c)
+
+	var status string
+	err := h.db.QueryRow("SELECT consent_status FROM users WHERE id = $1", userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, guardian_id, guardian_email, method, policy_version, granted_at
+		FROM consent_records
+		WHERE child_id = $1
+		ORDER BY granted_at DESC
+	`, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consent records",
+		})
+	}
+	defer rows.Close()
+
+	records := []models.ConsentRecord{}
+	for rows.Next() {
+		var r models.ConsentRecord
+		if err := rows.Scan(&r.ID, &r.GuardianID, &r.GuardianEmail, &r.Method, &r.PolicyVersion, &r.GrantedAt); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return c.JSON(models.ConsentStatusResponse{
+		Status:        status,
+		PolicyVersion: h.cfg.ConsentPolicyVersion,
+		Records:       records,
+	})
+}
+
+// RequestConsent emails a consent link to the verified email of each parent
+// linked to the child, where the link was made by the parent or approved by a
+// school admin. The child cannot choose the address: one they typed could be
+// a second mailbox of their own.
+func (h *ConsentHandler) RequestConsent(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var name, status string
+	err := h.db.QueryRow(`
+		SELECT name, consent_status FROM users WHERE id = $1
+	`, userID).Scan(&name, &status)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if status != middleware.ConsentPending {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Consent is not pending for this account",
+		})
+	}
+
+	rows, err := h.db.Query(`
+		SELECT u.email FROM guardianships g
+		JOIN users u ON u.id = g.guardian_id
+		WHERE g.child_id = $1 AND g.status = 'active' AND g.relationship = 'parent'
+		  AND g.approved_by IS DISTINCT FROM g.child_id
+		  AND u.role = 'parent' AND u.email IS NOT NULL AND u.email_verified_at IS NOT NULL
+		  AND u.banned_at IS NULL AND u.deleted_at IS NULL
+	`, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	guardianEmails := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err == nil {
+			guardianEmails = append(guardianEmails, email)
+		}
+	}
+	rows.Close()
+
+	if len(guardianEmails) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":             "No confirmed parent account is linked; ask your parent to link their verified account and a school admin to approve the link",
+			"guardian_required": true,
+		})
+	}
+
+	var recent bool
+	h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM consent_requests WHERE child_id = $1 AND created_at > $2)
+	`, userID, time.Now().Add(-verificationResendInterval)).Scan(&recent)
+	if recent {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Please wait before requesting another consent email",
+		})
+	}
+
+	for _, guardianEmail := range guardianEmails {
+		token, err := generateToken()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create consent request",
+			})
+		}
+
+		_, err = h.db.Exec(`
+			INSERT INTO consent_requests (child_id, guardian_email, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4)
+		`, userID, guardianEmail, middleware.HashToken(token), time.Now().Add(h.cfg.ConsentRequestExpiry))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create consent request",
+			})
+		}
+
+		link := fmt.Sprintf("%s/consent?token=%s", h.cfg.AppBaseURL, url.QueryEscape(token))
+		msg := mailer.Message{
+			To:      guardianEmail,
+			Subject: "Persetujuan orang tua untuk akun Gili",
+			Body: fmt.Sprintf(
+				"Halo,\n\n%s meminta persetujuan Anda sebagai orang tua/wali untuk memakai Gili, aplikasi belajar bercerita. "+
+					"Tanpa persetujuan, fitur seperti rekaman suara tetap nonaktif.\n\n"+
+					"Baca kebijakan privasi (versi %s) dan berikan persetujuan melalui tautan berikut:\n\n%s\n\n"+
+					"Abaikan email ini jika Anda tidak mengenal pengirimnya.",
+				name, h.cfg.ConsentPolicyVersion, link,
+			),
+		}
+		go func() {
+			if err := h.mailer.Send(msg); err != nil {
+				log.Printf("Failed to send consent email: %v", err)
+			}
+		}()
+	}
+
+	h.audit.Request(c, audit.ConsentRequested, audit.TargetUser, c.Locals("userID").(string), nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Consent request sent to guardian",
+	})
+}
+
+// ConfirmConsent is called from the emailed link by the guardian.
+func (h *ConsentHandler) ConfirmConsent(c *fiber.Ctx) error {
+	var req models.ConfirmConsentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is required",
+		})
+	}
+
+	if req.PolicyVersion != h.cfg.ConsentPolicyVersion {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":          "Please review the current privacy policy",
+			"policy_version": h.cfg.ConsentPolicyVersion,
+		})
+	}
+
+	var childID, guardianEmail string
+	err := h.db.QueryRow(`
+		UPDATE consent_requests SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING child_id, guardian_email
+	`, middleware.HashToken(req.Token)).Scan(&childID, &guardianEmail)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired consent link",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err := h.grantConsent(childID, nil, &guardianEmail, "email", c.IP()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record consent",
+		})
+	}
+
+	h.audit.RequestBy(c, "", "", "", audit.ConsentGranted, audit.TargetUser, childID, map[string]interface{}{
+		"method": "email",
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Consent recorded, thank you",
+	})
+}
+
+// GrantConsent lets a linked parent with a verified email consent for a child.
+// A link the child approved themselves does not count: the child could have
+// registered the parent account, so such links need a school admin's approval.
+func (h *ConsentHandler) GrantConsent(c *fiber.Ctx) error {
+	guardianID := c.Locals("userID").(string)
+	childID := middleware.SubjectUserID(c)
+
+	var req models.GrantConsentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.PolicyVersion != h.cfg.ConsentPolicyVersion {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":          "Please review the current privacy policy",
+			"policy_version": h.cfg.ConsentPolicyVersion,
+		})
+	}
+
+	var verified bool
+	h.db.QueryRow(`
+		SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1
+	`, guardianID).Scan(&verified)
+	if !verified {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Please verify your email address before giving consent",
+		})
+	}
+
+	var confirmed bool
+	h.db.QueryRow(`
+		SELECT approved_by IS DISTINCT FROM child_id FROM guardianships
+		WHERE guardian_id = $1 AND child_id = $2 AND status = 'active'
+	`, guardianID, childID).Scan(&confirmed)
+	if !confirmed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This link must be confirmed by a school admin before you can give consent",
+		})
+	}
+
+	if err := h.grantConsent(childID, &guardianID, nil, "guardian_account", c.IP()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record consent",
+		})
+	}
+
+	h.audit.Request(c, audit.ConsentGranted, audit.TargetUser, childID, map[string]interface{}{
+		"method": "guardian_account",
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Consent recorded",
+	})
+}
+
+func (h *ConsentHandler) grantConsent(childID string, guardianID, guardianEmail *string, method, ip string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO consent_records (child_id, guardian_id, guardian_email, method, policy_version, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, childID, guardianID, guardianEmail, method, h.cfg.ConsentPolicyVersion, truncate(ip, 45))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET consent_status = 'granted', updated_at = CURRENT_TIMESTAMP WHERE id = $1
+	`, childID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gili/backend/events"
+	"github.com/gili/backend/middleware"
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventsHeartbeat keeps idle streams open through proxies.
+const eventsHeartbeat = 25 * time.Second
+
+type EventHandler struct {
+	hub      *events.Hub
+	denylist *middleware.TokenDenylist
+}
+
+func NewEventHandler(hub *events.Hub, denylist *middleware.TokenDenylist) *EventHandler {
+	return &EventHandler{hub: hub, denylist: denylist}
+}
+
+// StreamStoryEvents streams changes to the student's stories as Server-Sent
+// Events: status transitions, feedback_ready once scores are saved, deleted
+// and restored. The stream opens with a ready event; clients fetch the
+// current state then and again on resync, which follows a gap in delivery.
+// The stream closes when the access token it was opened with expires or is
+// revoked, checked on every heartbeat; clients reconnect with a fresh token.
+func (h *EventHandler) StreamStoryEvents(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	claims := c.Locals("claims").(*middleware.Claims)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	sub, cancel := h.hub.Subscribe(userID)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		var expired <-chan time.Time
+		if claims.ExpiresAt != nil {
+			expiry := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+			defer expiry.Stop()
+			expired = expiry.C
+		}
+
+		if writeEvent(w, events.Event{Type: "ready"}) != nil {
+			return
+		}
+		for {
+			select {
+			case ev, ok := <-sub:
+				if !ok {
+					return
+				}
+				if writeEvent(w, ev) != nil {
+					return
+				}
+			case <-expired:
+				return
+			case <-heartbeat.C:
+				if h.denylist != nil && h.denylist.IsDenied(claims) {
+					return
+				}
+				fmt.Fprint(w, ": ping\n\n")
+				if w.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// writeEvent writes one event and flushes it; an error means the client has
+// gone away.
+func writeEvent(w *bufio.Writer, ev events.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return w.Flush()
+}
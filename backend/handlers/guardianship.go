@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GuardianshipHandler links parent and teacher accounts to students. The
+// student issues an invite code, the adult redeems it, and the link becomes
+// active once the student or a school admin approves it.
+type GuardianshipHandler struct {
+	db    *sql.DB
+	cfg   *config.Config
+	audit *audit.Recorder
+}
+
+func NewGuardianshipHandler(db *sql.DB, cfg *config.Config, rec *audit.Recorder) *GuardianshipHandler {
+	return &GuardianshipHandler{db: db, cfg: cfg, audit: rec}
+}
+
+func (h *GuardianshipHandler) CreateInvite(c *fiber.Ctx) error {
+	childID := c.Locals("userID").(string)
+
+	code, err := generateLoginCode(8)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate invite code",
+		})
+	}
+
+	expiresAt := time.Now().Add(h.cfg.GuardianInviteExpiry)
+	_, err = h.db.Exec(`
+		INSERT INTO guardianship_invites (child_id, code_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, childID, middleware.HashToken(code), expiresAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create invite",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.GuardianInviteResponse{
+		Code:      code,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// LinkGuardian redeems a child's invite code and creates a pending link.
+func (h *GuardianshipHandler) LinkGuardian(c *fiber.Ctx) error {
+	guardianID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+
+	var req models.LinkGuardianRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invite code is required",
+		})
+	}
+
+	var childID string
+	err := h.db.QueryRow(`
+		UPDATE guardianship_invites SET used_at = CURRENT_TIMESTAMP
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING child_id
+	`, middleware.HashToken(code)).Scan(&childID)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired invite code",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	var id string
+	err = h.db.QueryRow(`
+		INSERT INTO guardianships (guardian_id, child_id, relationship, status)
+		VALUES ($1, $2, $3, 'pending')
+		ON CONFLICT (guardian_id, child_id) DO NOTHING
+		RETURNING id
+	`, guardianID, childID, role).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Already linked to this child",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link child",
+		})
+	}
+
+	h.audit.Request(c, audit.GuardianLinked, audit.TargetGuardianship, id, map[string]interface{}{
+		"child_id": childID,
+	})
+
+	guardianship, err := h.getGuardianship(id, guardianID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(guardianship)
+}
+
+func (h *GuardianshipHandler) GetGuardianships(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT g.id, g.guardian_id, g.child_id, o.name, g.relationship, g.status, g.approved_at, g.created_at
+		FROM guardianships g
+		JOIN users o ON o.id = CASE WHEN g.guardian_id = $1 THEN g.child_id ELSE g.guardian_id END
+		WHERE g.guardian_id = $1 OR g.child_id = $1
+		ORDER BY g.created_at DESC
+	`, userID)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch guardianships",
+		})
+	}
+	defer rows.Close()
+
+	guardianships := []models.Guardianship{}
+	for rows.Next() {
+		var g models.Guardianship
+		err := rows.Scan(
+			&g.ID, &g.GuardianID, &g.ChildID, &g.OtherName,
+			&g.Relationship, &g.Status, &g.ApprovedAt, &g.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		guardianships = append(guardianships, g)
+	}
+
+	return c.JSON(models.GuardianshipListResponse{
+		Guardianships: guardianships,
+		TotalCount:    len(guardianships),
+	})
+}
+
+// ApproveGuardianship activates a pending link. Only the child or an admin
+// (acting for the school) may approve.
+func (h *GuardianshipHandler) ApproveGuardianship(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+	id := c.Params("id")
+
+	if _, err := uuid.Parse(id); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Guardianship not found",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE guardianships
+		SET status = 'active', approved_by = $1, approved_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = 'pending' AND (child_id = $1 OR $3)
+	`, userID, id, role == middleware.RoleAdmin)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to approve guardianship",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending guardianship not found",
+		})
+	}
+
+	h.audit.Request(c, audit.GuardianApproved, audit.TargetGuardianship, id, nil)
+
+	guardianship, err := h.getGuardianship(id, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(guardianship)
+}
+
+// Unlink removes a link. Either side (or an admin) may unlink, except the
+// last guardian of a managed child account, who is the only one able to
+// reset its PIN.
+func (h *GuardianshipHandler) Unlink(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+	id := c.Params("id")
+
+	if _, err := uuid.Parse(id); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Guardianship not found",
+		})
+	}
+
+	var guardianID, childID, status string
+	var managed bool
+	err := h.db.QueryRow(`
+		SELECT g.guardian_id, g.child_id, g.status, u.pin_hash IS NOT NULL
+		FROM guardianships g
+		JOIN users u ON u.id = g.child_id
+		WHERE g.id = $1
+	`, id).Scan(&guardianID, &childID, &status, &managed)
+
+	if err == sql.ErrNoRows || (err == nil && userID != guardianID && userID != childID && role != middleware.RoleAdmin) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Guardianship not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if managed && status == "active" {
+		var others int
+		h.db.QueryRow(`
+			SELECT COUNT(*) FROM guardianships
+			WHERE child_id = $1 AND status = 'active' AND id <> $2
+		`, childID, id).Scan(&others)
+		if others == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Cannot remove the only guardian of a managed child account",
+			})
+		}
+	}
+
+	if _, err := h.db.Exec("DELETE FROM guardianships WHERE id = $1", id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink",
+		})
+	}
+
+	h.audit.Request(c, audit.GuardianUnlinked, audit.TargetGuardianship, id, map[string]interface{}{
+		"guardian_id": guardianID,
+		"child_id":    childID,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Unlinked successfully",
+	})
+}
+
+func (h *GuardianshipHandler) getGuardianship(id, viewerID string) (*models.Guardianship, error) {
+	var g models.Guardianship
+	err := h.db.QueryRow(`
+		SELECT g.id, g.guardian_id, g.child_id, o.name, g.relationship, g.status, g.approved_at, g.created_at
+		FROM guardianships g
+		JOIN users o ON o.id = CASE WHEN g.guardian_id = $2 THEN g.child_id ELSE g.guardian_id END
+		WHERE g.id = $1
+	`, id, viewerID).Scan(
+		&g.ID, &g.GuardianID, &g.ChildID, &g.OtherName,
+		&g.Relationship, &g.Status, &g.ApprovedAt, &g.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// minAggregateGroupSize is the fewest students whose progress is reported to
+// a school, so that aggregates never describe one child.
+const minAggregateGroupSize = 5
+
+// IntegrationHandler serves school systems authenticated with an
+// organization API key (see middleware.APIKeyAuth). Schools only see their
+// own roster, identified by their own external IDs, and aggregate progress.
+// Accounts are on the roster only once their holder has accepted the
+// school's invitation or an admin has attached them.
+type IntegrationHandler struct {
+	db    *sql.DB
+	cfg   *config.Config
+	audit *audit.Recorder
+}
+
+func NewIntegrationHandler(db *sql.DB, cfg *config.Config, rec *audit.Recorder) *IntegrationHandler {
+	return &IntegrationHandler{db: db, cfg: cfg, audit: rec}
+}
+
+func (h *IntegrationHandler) GetRoster(c *fiber.Ctx) error {
+	orgID := c.Locals("organizationID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT m.user_id, m.external_id, u.role, m.class_name, m.updated_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = $1 AND m.status = 'active'
+		ORDER BY m.class_name NULLS LAST, m.external_id
+	`, orgID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch roster",
+		})
+	}
+	defer rows.Close()
+
+	members := []models.RosterMember{}
+	for rows.Next() {
+		var m models.RosterMember
+		if err := rows.Scan(&m.UserID, &m.ExternalID, &m.Role, &m.ClassName, &m.UpdatedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+
+	return c.JSON(models.RosterResponse{
+		Members:    members,
+		TotalCount: len(members),
+	})
+}
+
+// SyncRoster invites existing student and teacher accounts, found by email or
+// username, to the organization and records the school's external ID and
+// class. Entries are upserted by external ID. The response does not say which
+// entries matched an account; invited accounts appear on the roster once
+// their holder accepts.
+func (h *IntegrationHandler) SyncRoster(c *fiber.Ctx) error {
+	orgID := c.Locals("organizationID").(string)
+	key := c.Locals("apiKey").(*middleware.APIKey)
+
+	var req models.SyncRosterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(req.Members) == 0 || len(req.Members) > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Between 1 and 1000 members are required",
+		})
+	}
+	for _, m := range req.Members {
+		if m.ExternalID == "" || len(m.ExternalID) > 100 || len(m.ClassName) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Each member needs an external_id (at most 100 characters)",
+			})
+		}
+		if m.Email == "" && m.Username == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":       "Each member needs an email or username",
+				"external_id": m.ExternalID,
+			})
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	invited := 0
+	for _, m := range req.Members {
+		var userID string
+		err := tx.QueryRow(`
+			SELECT id FROM users
+			WHERE (($1 <> '' AND LOWER(email) = LOWER($1)) OR ($2 <> '' AND username = LOWER($2)))
+			  AND role IN ('student', 'teacher') AND deleted_at IS NULL
+			LIMIT 1
+		`, strings.TrimSpace(m.Email), strings.TrimSpace(m.Username)).Scan(&userID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+
+		// An external ID held by another member stays theirs; removing them
+		// would show the school which entry matched
+		var taken bool
+		err = tx.QueryRow(`
+			SELECT EXISTS(
+				SELECT 1 FROM organization_members
+				WHERE organization_id = $1 AND external_id = $2 AND user_id <> $3 AND status = 'active'
+			)
+		`, orgID, m.ExternalID, userID).Scan(&taken)
+		if err == nil && taken {
+			continue
+		}
+
+		// A user already invited under another external ID keeps a single
+		// membership. Declined invitations are kept so they are not sent again.
+		if err == nil {
+			_, err = tx.Exec(`
+				DELETE FROM organization_members
+				WHERE organization_id = $1 AND external_id = $2 AND user_id <> $3
+			`, orgID, m.ExternalID, userID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO organization_members (organization_id, user_id, external_id, class_name, status)
+				VALUES ($1, $2, $3, NULLIF($4, ''), 'invited')
+				ON CONFLICT (organization_id, user_id) DO UPDATE
+				SET external_id = EXCLUDED.external_id, class_name = EXCLUDED.class_name,
+				    updated_at = CURRENT_TIMESTAMP
+			`, orgID, userID, m.ExternalID, m.ClassName)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to sync roster",
+			})
+		}
+		invited++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to sync roster",
+		})
+	}
+
+	h.audit.RequestBy(c, "", "", "", audit.RosterSynced, audit.TargetOrganization, orgID, map[string]interface{}{
+		"api_key_id": key.ID,
+		"received":   len(req.Members),
+		"matched":    invited,
+	})
+
+	return c.JSON(models.SyncRosterResponse{Received: len(req.Members)})
+}
+
+// RemoveRosterMember unlinks the member with the given external ID, or
+// withdraws its invitation. The Gili account itself is not touched. Pending
+// invitations answer like unknown IDs, so that matches are not revealed.
+func (h *IntegrationHandler) RemoveRosterMember(c *fiber.Ctx) error {
+	orgID := c.Locals("organizationID").(string)
+	key := c.Locals("apiKey").(*middleware.APIKey)
+	externalID := c.Params("externalId")
+
+	var userID, status string
+	err := h.db.QueryRow(`
+		DELETE FROM organization_members WHERE organization_id = $1 AND external_id = $2
+		RETURNING user_id, status
+	`, orgID, externalID).Scan(&userID, &status)
+	if err == sql.ErrNoRows || (err == nil && status != "active") {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Member not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove member",
+		})
+	}
+
+	h.audit.RequestBy(c, "", "", "", audit.RosterMemberRemoved, audit.TargetUser, userID, map[string]interface{}{
+		"api_key_id":      key.ID,
+		"organization_id": orgID,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Member removed",
+	})
+}
+
+// GetProgress reports aggregate learning progress for the organization's
+// students. Nothing is reported for fewer than minAggregateGroupSize
+// students. There is no breakdown by class: schools name classes themselves
+// and could otherwise put one child in a class with students they know.
+func (h *IntegrationHandler) GetProgress(c *fiber.Ctx) error {
+	orgID := c.Locals("organizationID").(string)
+
+	resp := models.OrganizationProgressResponse{
+		Skills:       []models.SkillAggregate{},
+		MinGroupSize: minAggregateGroupSize,
+	}
+
+	err := h.db.QueryRow(`
+		SELECT COUNT(DISTINCT m.user_id), COUNT(s.id)
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id AND u.role = 'student' AND u.deleted_at IS NULL
+		LEFT JOIN stories s ON s.user_id = m.user_id AND s.status = 'completed' AND s.deleted_at IS NULL
+		WHERE m.organization_id = $1 AND m.status = 'active'
+	`, orgID).Scan(&resp.StudentCount, &resp.CompletedStories)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch progress",
+		})
+	}
+	if resp.StudentCount < minAggregateGroupSize {
+		resp.CompletedStories = 0
+		return c.JSON(resp)
+	}
+
+	// Level and progress sums per skill, averaged by skillAggregate. Only
+	// students with evaluated stories have skill progress, so each skill needs
+	// minAggregateGroupSize students of its own.
+	rows, err := h.db.Query(`
+		SELECT sk.name, SUM(sp.level), SUM(sp.progress), COUNT(*)
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id AND u.role = 'student' AND u.deleted_at IS NULL
+		JOIN skill_progress sp ON sp.user_id = m.user_id
+		JOIN skills sk ON sk.id = sp.skill_id
+		WHERE m.organization_id = $1 AND m.status = 'active'
+		GROUP BY sk.name
+		HAVING COUNT(*) >= $2
+		ORDER BY sk.name
+	`, orgID, minAggregateGroupSize)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch progress",
+		})
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var skill string
+		var level, progress, count int
+		if err := rows.Scan(&skill, &level, &progress, &count); err != nil || count < minAggregateGroupSize {
+			continue
+		}
+		resp.Skills = append(resp.Skills, skillAggregate(skill, level, progress, count))
+	}
+
+	return c.JSON(resp)
+}
+
+func skillAggregate(skill string, level, progress, count int) models.SkillAggregate {
+	return models.SkillAggregate{
+		Skill:           skill,
+		AverageLevel:    math.Round(float64(level)/float64(count)*100) / 100,
+		AverageProgress: math.Round(float64(progress)/float64(count)*100) / 100,
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"github.com/gili/backend/middleware"
+	"github.com/gofiber/fiber/v2"
+)
+
+type JWKSHandler struct {
+	keys *middleware.KeyManager
+}
+
+func NewJWKSHandler(keys *middleware.KeyManager) *JWKSHandler {
+	return &JWKSHandler{keys: keys}
+}
+
+// GetJWKS publishes the public keys other services use to verify Gili JWTs.
+func (h *JWKSHandler) GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.keys.JWKS())
+}
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gili/backend/totp"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recoveryCodeCount is how many single-use recovery codes are issued.
+const recoveryCodeCount = 10
+
+// MFAHandler manages TOTP enrollment for parent, teacher and admin accounts.
+// The login side (challenge and verification) lives in AuthHandler.
+type MFAHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	denylist *middleware.TokenDenylist
+	policy   *middleware.MFAPolicy
+	audit    *audit.Recorder
+}
+
+func NewMFAHandler(db *sql.DB, cfg *config.Config, denylist *middleware.TokenDenylist, policy *middleware.MFAPolicy, rec *audit.Recorder) *MFAHandler {
+	return &MFAHandler{db: db, cfg: cfg, denylist: denylist, policy: policy, audit: rec}
+}
+
+func (h *MFAHandler) GetStatus(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+
+	var status models.MFAStatusResponse
+	err := h.db.QueryRow(`
+		SELECT mfa_enabled_at,
+		       (SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+		FROM users WHERE id = $1
+	`, userID).Scan(&status.EnabledAt, &status.RecoveryCodesRemaining)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	status.Enabled = status.EnabledAt != nil
+	status.Required = h.policy.Required(role)
+	return c.JSON(status)
+}
+
+// Setup creates a new TOTP secret for the caller. It only takes effect once
+// confirmed with a code from the authenticator app.
+func (h *MFAHandler) Setup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	email, _ := c.Locals("email").(string)
+
+	var enabled bool
+	h.db.QueryRow("SELECT mfa_enabled_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&enabled)
+	if enabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	sealed, err := encryptMFASecret(h.cfg, secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO mfa_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, confirmed_at = NULL, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+	`, userID, sealed)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store secret",
+		})
+	}
+
+	return c.JSON(models.MFASetupResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(h.cfg.MFAIssuer, email, secret),
+	})
+}
+
+// Confirm enables 2FA once the user proves the authenticator app works, and
+// returns the recovery codes. They are shown only this once.
+func (h *MFAHandler) Confirm(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	var req models.MFACodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var enabled bool
+	h.db.QueryRow("SELECT mfa_enabled_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&enabled)
+	if enabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	ok, err := verifyTOTP(h.db, h.cfg, userID, req.Code, false)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Start two-factor setup first",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE mfa_totp SET confirmed_at = CURRENT_TIMESTAMP WHERE user_id = $1", userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET mfa_enabled_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = $1", userID)
+	}
+
+	var codes []string
+	if err == nil {
+		codes, err = replaceRecoveryCodes(tx, userID)
+	}
+	if err != nil || tx.Commit() != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+
+	// Sessions opened with the password alone are signed out
+	if _, err := revokeSessions(h.db, h.denylist, userID, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	h.audit.Request(c, audit.MFAEnabled, audit.TargetUser, userID, nil)
+
+	return c.JSON(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func (h *MFAHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req models.MFACodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ok, err := verifyTOTP(h.db, h.cfg, userID, req.Code, true)
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	h.audit.Request(c, audit.RecoveryCodesRegenerated, audit.TargetUser, userID, nil)
+
+	return c.JSON(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Disable turns 2FA off with the password and a current code. Accounts whose
+// role requires 2FA cannot turn it off.
+func (h *MFAHandler) Disable(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	role := c.Locals("role").(string)
+
+	var req models.DisableMFARequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if h.policy.Required(role) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is required for your role",
+		})
+	}
+
+	var passwordHash string
+	h.db.QueryRow("SELECT COALESCE(password_hash, '') FROM users WHERE id = $1", userID).Scan(&passwordHash)
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Password is incorrect",
+		})
+	}
+
+	ok, err := verifyTOTP(h.db, h.cfg, userID, req.Code, true)
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	if err := disableMFA(h.db, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+
+	h.audit.Request(c, audit.MFADisabled, audit.TargetUser, userID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// verifyTOTP checks code against the user's secret. With confirmed set only
+// an enabled secret is accepted. A code is accepted once: its time step is
+// recorded and earlier or equal steps are refused afterwards.
+func verifyTOTP(db *sql.DB, cfg *config.Config, userID, code string, confirmed bool) (bool, error) {
+	var sealed []byte
+	var isConfirmed bool
+	err := db.QueryRow(`
+		SELECT secret, confirmed_at IS NOT NULL FROM mfa_totp WHERE user_id = $1
+	`, userID).Scan(&sealed, &isConfirmed)
+	if err != nil {
+		return false, err
+	}
+	if confirmed && !isConfirmed {
+		return false, sql.ErrNoRows
+	}
+
+	secret, err := decryptMFASecret(cfg, sealed)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	res, err := db.Exec(`
+		UPDATE mfa_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1
+	`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// useRecoveryCode marks a matching unused recovery code as used.
+func useRecoveryCode(db *sql.DB, userID, code string) bool {
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false
+	}
+
+	res, err := db.Exec(`
+		UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, middleware.HashToken(normalized))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// replaceRecoveryCodes discards existing recovery codes and returns new ones.
+// Only their SHA-256 hashes are stored; the codes carry ~50 bits of entropy.
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := generateLoginCode(10)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, middleware.HashToken(raw))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != 10 {
+		return ""
+	}
+	return code
+}
+
+// disableMFA removes the user's TOTP secret, recovery codes and pending
+// challenges.
+func disableMFA(db *sql.DB, userID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"DELETE FROM mfa_totp WHERE user_id = $1",
+		"DELETE FROM mfa_recovery_codes WHERE user_id = $1",
+		"DELETE FROM mfa_challenges WHERE user_id = $1",
+		"UPDATE users SET mfa_enabled_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1",
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func mfaCipher(cfg *config.Config) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("mfa:" + cfg.JWTSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptMFASecret(cfg *config.Config, secret string) ([]byte, error) {
+	aead, err := mfaCipher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(secret), nil), nil
+}
+
+func decryptMFASecret(cfg *config.Config, data []byte) (string, error) {
+	aead, err := mfaCipher(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	size := aead.NonceSize()
+	if len(data) < size {
+		return "", errors.New("ciphertext too short")
+	}
+
+	secret, err := aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
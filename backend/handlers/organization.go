@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// OrganizationHandler lets admins register schools and issue the API keys
+// their systems use to sync rosters and read aggregate progress.
+type OrganizationHandler struct {
+	db    *sql.DB
+	cfg   *config.Config
+	audit *audit.Recorder
+}
+
+func NewOrganizationHandler(db *sql.DB, cfg *config.Config, rec *audit.Recorder) *OrganizationHandler {
+	return &OrganizationHandler{db: db, cfg: cfg, audit: rec}
+}
+
+func (h *OrganizationHandler) CreateOrganization(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+
+	var req models.CreateOrganizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if len(req.Name) < 2 || len(req.Name) > 200 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name must be between 2 and 200 characters",
+		})
+	}
+
+	var org models.Organization
+	err := h.db.QueryRow(`
+		INSERT INTO organizations (name, created_by) VALUES ($1, $2)
+		RETURNING id, name, created_at
+	`, req.Name, adminID).Scan(&org.ID, &org.Name, &org.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create organization",
+		})
+	}
+
+	h.audit.Request(c, audit.OrganizationCreated, audit.TargetOrganization, org.ID, map[string]interface{}{
+		"name": org.Name,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(org)
+}
+
+func (h *OrganizationHandler) GetOrganizations(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT o.id, o.name, o.created_at,
+		       (SELECT COUNT(*) FROM organization_members m WHERE m.organization_id = o.id AND m.status = 'active')
+		FROM organizations o
+		ORDER BY o.name
+	`)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch organizations",
+		})
+	}
+	defer rows.Close()
+
+	orgs := []models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedAt, &org.MemberCount); err != nil {
+			continue
+		}
+		orgs = append(orgs, org)
+	}
+
+	return c.JSON(models.OrganizationListResponse{
+		Organizations: orgs,
+		TotalCount:    len(orgs),
+	})
+}
+
+// CreateAPIKey issues a key for the organization. The key is returned once;
+// only its SHA-256 hash is stored.
+func (h *OrganizationHandler) CreateAPIKey(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	orgID := c.Params("id")
+
+	if !h.organizationExists(orgID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Organization not found",
+		})
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required (at most 100 characters)",
+		})
+	}
+
+	if len(req.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one scope is required",
+		})
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, s := range req.Scopes {
+		if !middleware.ValidScope(s) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Scopes must be 'roster:read', 'roster:write' or 'progress:read'",
+			})
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+
+	rateLimit := req.RateLimit
+	if rateLimit == 0 {
+		rateLimit = h.cfg.APIKeyDefaultRateLimit
+	}
+	if rateLimit < 1 || rateLimit > h.cfg.APIKeyMaxRateLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":          "rate_limit is out of range",
+			"max_rate_limit": h.cfg.APIKeyMaxRateLimit,
+		})
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		if *req.ExpiresInDays < 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "expires_in_days must be at least 1",
+			})
+		}
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate API key",
+		})
+	}
+	key := middleware.APIKeyPrefix + secret
+	prefix := key[:len(middleware.APIKeyPrefix)+8]
+
+	var resp models.CreateAPIKeyResponse
+	err = h.db.QueryRow(`
+		INSERT INTO api_keys (organization_id, name, key_prefix, key_hash, scopes, rate_limit, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	`, orgID, req.Name, prefix, middleware.HashToken(key), pq.Array(scopes), rateLimit, adminID, expiresAt,
+	).Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create API key",
+		})
+	}
+
+	resp.OrganizationID = orgID
+	resp.Name = req.Name
+	resp.KeyPrefix = prefix
+	resp.Scopes = scopes
+	resp.RateLimit = rateLimit
+	resp.ExpiresAt = expiresAt
+	resp.Key = key
+
+	h.audit.Request(c, audit.APIKeyCreated, audit.TargetAPIKey, resp.ID, map[string]interface{}{
+		"organization_id": orgID,
+		"scopes":          scopes,
+		"rate_limit":      rateLimit,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+func (h *OrganizationHandler) GetAPIKeys(c *fiber.Ctx) error {
+	orgID := c.Params("id")
+
+	if !h.organizationExists(orgID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Organization not found",
+		})
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, organization_id, name, key_prefix, scopes, rate_limit,
+		       last_used_at, expires_at, revoked_at, created_at
+		FROM api_keys
+		WHERE organization_id = $1
+		ORDER BY created_at DESC
+	`, orgID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch API keys",
+		})
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var k models.APIKey
+		if err := rows.Scan(
+			&k.ID, &k.OrganizationID, &k.Name, &k.KeyPrefix, pq.Array(&k.Scopes), &k.RateLimit,
+			&k.LastUsedAt, &k.ExpiresAt, &k.RevokedAt, &k.CreatedAt,
+		); err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	return c.JSON(models.APIKeyListResponse{
+		APIKeys:    keys,
+		TotalCount: len(keys),
+	})
+}
+
+// RevokeAPIKey stops a key from working immediately.
+func (h *OrganizationHandler) RevokeAPIKey(c *fiber.Ctx) error {
+	orgID := c.Params("id")
+	keyID := c.Params("keyId")
+
+	if _, err := uuid.Parse(keyID); err != nil || !h.organizationExists(orgID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND organization_id = $2 AND revoked_at IS NULL
+	`, keyID, orgID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke API key",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+
+	h.audit.Request(c, audit.APIKeyRevoked, audit.TargetAPIKey, keyID, map[string]interface{}{
+		"organization_id": orgID,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "API key revoked",
+	})
+}
+
+// AddMember attaches an existing student or teacher account to the
+// organization directly, without an invitation.
+func (h *OrganizationHandler) AddMember(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	orgID := c.Params("id")
+
+	if !h.organizationExists(orgID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Organization not found",
+		})
+	}
+
+	var req models.AddOrganizationMemberRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.ExternalID = strings.TrimSpace(req.ExternalID)
+	if req.ExternalID == "" || len(req.ExternalID) > 100 || len(req.ClassName) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "external_id is required (at most 100 characters)",
+		})
+	}
+
+	var exists bool
+	if _, err := uuid.Parse(req.UserID); err == nil {
+		h.db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND role IN ('student', 'teacher') AND deleted_at IS NULL)
+		`, req.UserID).Scan(&exists)
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Student or teacher not found",
+		})
+	}
+
+	_, err := h.db.Exec(`
+		INSERT INTO organization_members
+			(organization_id, user_id, external_id, class_name, status, approved_by, approved_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), 'active', $5, CURRENT_TIMESTAMP)
+		ON CONFLICT (organization_id, user_id) DO UPDATE
+		SET external_id = EXCLUDED.external_id, class_name = EXCLUDED.class_name, status = 'active',
+		    approved_by = EXCLUDED.approved_by, approved_at = EXCLUDED.approved_at,
+		    updated_at = CURRENT_TIMESTAMP
+	`, orgID, req.UserID, req.ExternalID, req.ClassName, adminID)
+	if isUniqueViolation(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "external_id is already used by another member",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add member",
+		})
+	}
+
+	h.audit.Request(c, audit.OrganizationMemberAdded, audit.TargetUser, req.UserID, map[string]interface{}{
+		"organization_id": orgID,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Member added",
+	})
+}
+
+// GetMemberships lists the organizations the user belongs to or has been
+// invited to by a school's roster sync.
+func (h *OrganizationHandler) GetMemberships(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT o.id, o.name, m.class_name, m.status, m.approved_at, m.created_at
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.organization_id
+		WHERE m.user_id = $1
+		ORDER BY m.created_at DESC
+	`, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch organizations",
+		})
+	}
+	defer rows.Close()
+
+	memberships := []models.OrganizationMembership{}
+	for rows.Next() {
+		var m models.OrganizationMembership
+		if err := rows.Scan(
+			&m.OrganizationID, &m.OrganizationName, &m.ClassName, &m.Status, &m.ApprovedAt, &m.CreatedAt,
+		); err != nil {
+			continue
+		}
+		memberships = append(memberships, m)
+	}
+
+	return c.JSON(models.OrganizationMembershipListResponse{
+		Memberships: memberships,
+		TotalCount:  len(memberships),
+	})
+}
+
+// AcceptMembership accepts a school's invitation, also one declined before.
+// From then on the school sees the account on its roster and counts it in
+// aggregate progress.
+func (h *OrganizationHandler) AcceptMembership(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	orgID := c.Params("id")
+
+	if _, err := uuid.Parse(orgID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invitation not found",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE organization_members
+		SET status = 'active', approved_by = $1, approved_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE organization_id = $2 AND user_id = $1 AND status <> 'active'
+	`, userID, orgID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to accept invitation",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invitation not found",
+		})
+	}
+
+	h.audit.Request(c, audit.OrganizationJoined, audit.TargetOrganization, orgID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Invitation accepted",
+	})
+}
+
+// LeaveOrganization declines an invitation or leaves an organization. The
+// entry is kept as declined so that the next roster sync does not invite the
+// user again.
+func (h *OrganizationHandler) LeaveOrganization(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	orgID := c.Params("id")
+
+	if _, err := uuid.Parse(orgID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Organization not found",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE organization_members
+		SET status = 'declined', approved_by = NULL, approved_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE organization_id = $1 AND user_id = $2 AND status <> 'declined'
+	`, orgID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to leave organization",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Organization not found",
+		})
+	}
+
+	h.audit.Request(c, audit.OrganizationLeft, audit.TargetOrganization, orgID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Left organization",
+	})
+}
+
+func (h *OrganizationHandler) organizationExists(orgID string) bool {
+	if _, err := uuid.Parse(orgID); err != nil {
+		return false
+	}
+
+	var exists bool
+	h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM organizations WHERE id = $1)", orgID).Scan(&exists)
+	return exists
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/mailer"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetInterval is the minimum time between reset codes for one
+// account; requests in between are ignored.
+const passwordResetInterval = time.Minute
+
+// ForgotPassword emails a single-use reset code. The response is the same
+// whether or not the email is registered.
+func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
+	var req models.ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	// All of the work happens in the background so that neither the response
+	// nor its timing reveals whether the email exists
+	go h.sendPasswordReset(req.Email)
+
+	return c.JSON(fiber.Map{
+		"message": "If the email is registered, a reset code has been sent",
+	})
+}
+
+// sendPasswordReset replaces the account's reset code with a new one and
+// emails it, unless a code was sent within passwordResetInterval.
+func (h *AuthHandler) sendPasswordReset(email string) {
+	var userID, name string
+	err := h.db.QueryRow("SELECT id, name FROM users WHERE email = $1", email).Scan(&userID, &name)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up user for password reset: %v", err)
+		return
+	}
+
+	code, err := generateNumericCode(6)
+	if err != nil {
+		log.Printf("Failed to generate password reset code: %v", err)
+		return
+	}
+
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Failed to hash password reset code: %v", err)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Failed to create password reset code: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the user serialises concurrent requests for the same account
+	var recent bool
+	err = tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM password_resets WHERE user_id = $1 AND created_at > $2)
+		FROM users WHERE id = $1 FOR UPDATE
+	`, userID, time.Now().Add(-passwordResetInterval)).Scan(&recent)
+	if err != nil {
+		log.Printf("Failed to create password reset code: %v", err)
+		return
+	}
+	if recent {
+		return
+	}
+
+	// Only the latest code is valid
+	_, err = tx.Exec(`
+		UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO password_resets (user_id, code_hash, expires_at)
+			VALUES ($1, $2, $3)
+		`, userID, string(codeHash), time.Now().Add(h.cfg.PasswordResetExpiry))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create password reset code: %v", err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Kode reset password Gili",
+		Body: fmt.Sprintf(
+			"Halo %s,\n\nKode untuk mengatur ulang password Gili kamu: %s\n\nKode ini berlaku %d menit dan hanya bisa dipakai sekali. Abaikan email ini jika kamu tidak meminta reset password.",
+			name, code, int(h.cfg.PasswordResetExpiry.Minutes()),
+		),
+	}
+	if err := h.mailer.Send(msg); err != nil {
+		log.Printf("Failed to send password reset email: %v", err)
+	}
+}
+
+// ResetPassword sets a new password using a reset code and signs the user out
+// of every session.
+func (h *AuthHandler) ResetPassword(c *fiber.Ctx) error {
+	var req models.ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Email == "" || req.Code == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email, code, and new password are required",
+		})
+	}
+
+	if len(req.NewPassword) < 6 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password must be at least 6 characters",
+		})
+	}
+
+	invalid := fiber.Map{
+		"error": "Invalid or expired reset code",
+	}
+
+	var resetID, userID, codeHash string
+	err := h.db.QueryRow(`
+		SELECT r.id, r.user_id, r.code_hash
+		FROM password_resets r
+		JOIN users u ON u.id = r.user_id
+		WHERE u.email = $1 AND r.used_at IS NULL AND r.expires_at > CURRENT_TIMESTAMP
+		ORDER BY r.created_at DESC
+		LIMIT 1
+	`, req.Email).Scan(&resetID, &userID, &codeHash)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// Claim an attempt before comparing, so that parallel guesses cannot get
+	// past the limit
+	res, err := h.db.Exec(`
+		UPDATE password_resets SET attempts = attempts + 1
+		WHERE id = $1 AND used_at IS NULL AND attempts < $2
+	`, resetID, h.cfg.PasswordResetMaxAttempts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(req.Code)); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
+	}
+
+	// Consume the code; a concurrent request using the same code loses here
+	res, err = h.db.Exec(`
+		UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL
+	`, resetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+
+	// Sign out everywhere
+	if _, err := revokeSessions(h.db, h.denylist, userID, ""); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	h.denylist.DenyUser(userID)
+
+	h.audit.RequestBy(c, userID, "", "", audit.PasswordReset, audit.TargetUser, userID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Password has been reset, please log in again",
+	})
+}
+
+// generateNumericCode returns a random decimal code of the given length.
+func generateNumericCode(length int) (string, error) {
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code), nil
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/database"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PrivacyHandler implements the data subject rights required by UU PDP:
+// account deletion after a grace period and a downloadable export of the
+// user's personal data. Archives are built and accounts purged by
+// privacy.Worker. Guardians exercise these rights for managed child accounts
+// through the /children/:id routes.
+type PrivacyHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	rmq      *database.RabbitMQ
+	denylist *middleware.TokenDenylist
+	audit    *audit.Recorder
+}
+
+func NewPrivacyHandler(db *sql.DB, cfg *config.Config, rmq *database.RabbitMQ, denylist *middleware.TokenDenylist, rec *audit.Recorder) *PrivacyHandler {
+	return &PrivacyHandler{db: db, cfg: cfg, rmq: rmq, denylist: denylist, audit: rec}
+}
+
+// DeleteAccount schedules the account for deletion. Users confirm with their
+// password; a guardian may only delete managed child accounts, which have
+// none. Other sessions are signed out immediately, the account itself is
+// anonymised once the grace period has passed.
+func (h *PrivacyHandler) DeleteAccount(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	subjectID := middleware.SubjectUserID(c)
+	self := subjectID == userID
+
+	var req models.DeleteAccountRequest
+	if err := c.BodyParser(&req); err != nil && len(c.Body()) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var passwordHash string
+	var managed bool
+	err := h.db.QueryRow(`
+		SELECT COALESCE(password_hash, ''), pin_hash IS NOT NULL
+		FROM users WHERE id = $1 AND deleted_at IS NULL
+	`, subjectID).Scan(&passwordHash, &managed)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if self {
+		if passwordHash == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Ask your parent or teacher to delete this account",
+			})
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Password is incorrect",
+			})
+		}
+	} else if !managed || passwordHash != "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only managed child accounts can be deleted by a guardian",
+		})
+	}
+
+	// Managed children must not be left without anyone able to reset their PIN
+	var orphans int
+	h.db.QueryRow(`
+		SELECT COUNT(*) FROM guardianships g
+		JOIN users u ON u.id = g.child_id
+		WHERE g.guardian_id = $1 AND g.status = 'active' AND u.pin_hash IS NOT NULL AND u.deleted_at IS NULL
+		  AND NOT EXISTS (
+		      SELECT 1 FROM guardianships o
+		      WHERE o.child_id = g.child_id AND o.status = 'active' AND o.guardian_id <> $1
+		  )
+	`, subjectID).Scan(&orphans)
+	if orphans > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Delete your managed child accounts or add another guardian first",
+		})
+	}
+
+	var scheduledAt time.Time
+	err = h.db.QueryRow(`
+		UPDATE users
+		SET deletion_requested_at = COALESCE(deletion_requested_at, CURRENT_TIMESTAMP),
+		    deletion_scheduled_at = COALESCE(deletion_scheduled_at, $1),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+		RETURNING deletion_scheduled_at
+	`, time.Now().Add(h.cfg.AccountDeletionGracePeriod), subjectID).Scan(&scheduledAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to schedule account deletion",
+		})
+	}
+
+	// Keep the caller's own session so the deletion can still be cancelled
+	keepID := ""
+	if self {
+		keepID, _ = c.Locals("sessionID").(string)
+	}
+	if _, err := revokeSessions(h.db, h.denylist, subjectID, keepID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	h.audit.Request(c, audit.DeletionRequested, audit.TargetUser, subjectID, map[string]interface{}{
+		"deletion_scheduled_at": scheduledAt,
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(models.AccountDeletionResponse{
+		Message:             "Account scheduled for deletion",
+		DeletionScheduledAt: scheduledAt,
+	})
+}
+
+// CancelDeletion withdraws a pending deletion request during the grace period.
+func (h *PrivacyHandler) CancelDeletion(c *fiber.Ctx) error {
+	subjectID := middleware.SubjectUserID(c)
+
+	result, err := h.db.Exec(`
+		UPDATE users
+		SET deletion_requested_at = NULL, deletion_scheduled_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL AND deleted_at IS NULL
+	`, subjectID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel account deletion",
+		})
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No pending account deletion",
+		})
+	}
+
+	h.audit.Request(c, audit.DeletionCancelled, audit.TargetUser, subjectID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Account deletion cancelled",
+	})
+}
+
+// GetExport returns the latest personal data export, starting a new one if
+// there is none in progress or ready to download. Poll until status is
+// "ready", then fetch download_url.
+func (h *PrivacyHandler) GetExport(c *fiber.Ctx) error {
+	subjectID := middleware.SubjectUserID(c)
+
+	export, err := h.latestExport(subjectID)
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err == nil && export.Status != "failed" {
+		h.setDownloadURL(c, export)
+		if export.Status == "ready" {
+			return c.JSON(export)
+		}
+		return c.Status(fiber.StatusAccepted).JSON(export)
+	}
+
+	exportID := uuid.New().String()
+	_, err = h.db.Exec(`
+		INSERT INTO data_exports (id, user_id) VALUES ($1, $2)
+	`, exportID, subjectID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start data export",
+		})
+	}
+
+	h.audit.Request(c, audit.DataExportRequested, audit.TargetDataExport, exportID, map[string]interface{}{
+		"user_id": subjectID,
+	})
+
+	// If the message is lost the worker's periodic sweep builds it anyway
+	if h.rmq != nil {
+		h.rmq.PublishDataExport(exportID)
+	}
+
+	export, err = h.latestExport(subjectID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(export)
+}
+
+// DownloadExport streams a ready export archive to its owner.
+func (h *PrivacyHandler) DownloadExport(c *fiber.Ctx) error {
+	subjectID := middleware.SubjectUserID(c)
+	exportID := c.Params("exportId")
+
+	if _, err := uuid.Parse(exportID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Export not found",
+		})
+	}
+
+	var filePath string
+	var createdAt time.Time
+	err := h.db.QueryRow(`
+		SELECT file_path, created_at FROM data_exports
+		WHERE id = $1 AND user_id = $2 AND status = 'ready' AND expires_at > CURRENT_TIMESTAMP
+	`, exportID, subjectID).Scan(&filePath, &createdAt)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Export not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Export not found",
+		})
+	}
+
+	h.audit.Request(c, audit.DataExportDownloaded, audit.TargetDataExport, exportID, map[string]interface{}{
+		"user_id": subjectID,
+	})
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Download(filePath, fmt.Sprintf("gili-data-%s.zip", createdAt.Format("20060102")))
+}
+
+func (h *PrivacyHandler) latestExport(userID string) (*models.DataExport, error) {
+	var e models.DataExport
+	err := h.db.QueryRow(`
+		SELECT id, status, size_bytes, created_at, completed_at, expires_at
+		FROM data_exports
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID).Scan(&e.ID, &e.Status, &e.SizeBytes, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// setDownloadURL points a ready export at the download route matching the
+// one it was requested from (own account or a child's).
+func (h *PrivacyHandler) setDownloadURL(c *fiber.Ctx, e *models.DataExport) {
+	if e.Status != "ready" {
+		return
+	}
+	e.DownloadURL = fmt.Sprintf("%s/%s/download", c.Path(), e.ID)
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type SessionHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	denylist *middleware.TokenDenylist
+	audit    *audit.Recorder
+}
+
+func NewSessionHandler(db *sql.DB, cfg *config.Config, denylist *middleware.TokenDenylist, rec *audit.Recorder) *SessionHandler {
+	return &SessionHandler{db: db, cfg: cfg, denylist: denylist, audit: rec}
+}
+
+func (h *SessionHandler) GetSessions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	currentID, _ := c.Locals("sessionID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT id, device_name, platform, app_version, ip_address, last_used_at, created_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_used_at DESC
+	`, userID)
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch sessions",
+		})
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(
+			&session.ID, &session.DeviceName, &session.Platform, &session.AppVersion,
+			&session.IPAddress, &session.LastUsedAt, &session.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+
+	return c.JSON(models.SessionListResponse{
+		Sessions:   sessions,
+		TotalCount: len(sessions),
+	})
+}
+
+func (h *SessionHandler) RevokeSession(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID := c.Params("id")
+
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	}
+
+	if err := middleware.RevokeTokenFamily(h.db, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+	h.denylist.DenySession(sessionID)
+
+	h.audit.Request(c, audit.SessionRevoked, audit.TargetSession, sessionID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Session revoked",
+	})
+}
+
+func (h *SessionHandler) RevokeOtherSessions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	currentID, _ := c.Locals("sessionID").(string)
+
+	if currentID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Current session is unknown, please log in again",
+		})
+	}
+
+	revoked, err := revokeSessions(h.db, h.denylist, userID, currentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	h.audit.Request(c, audit.SessionRevoked, audit.TargetUser, userID, map[string]interface{}{
+		"scope":         "others",
+		"revoked_count": revoked,
+	})
+
+	return c.JSON(fiber.Map{
+		"message":       "Other sessions revoked",
+		"revoked_count": revoked,
+	})
+}
+
+// createSession records a new login and returns its ID, which is also used as
+// the refresh token family ID.
+func createSession(db execer, userID string, device models.DeviceInfo, ip string) (string, error) {
+	sessionID := uuid.New().String()
+	_, err := db.Exec(`
+		INSERT INTO sessions (id, user_id, device_name, platform, app_version, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, sessionID, userID,
+		nullString(truncate(device.DeviceName, 100)),
+		nullString(truncate(device.Platform, 20)),
+		nullString(truncate(device.AppVersion, 50)),
+		nullString(truncate(ip, 45)))
+	return sessionID, err
+}
+
+// touchSession updates the last-used time and IP of a session on refresh.
+func touchSession(db execer, sessionID, ip string) {
+	db.Exec(`
+		UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, ip_address = $1
+		WHERE id = $2
+	`, nullString(truncate(ip, 45)), sessionID)
+}
+
+// revokeSessions revokes every active session of a user together with its
+// refresh and access tokens, except keepID (pass "" to revoke all). It returns
+// the number of sessions revoked.
+func revokeSessions(db *sql.DB, denylist *middleware.TokenDenylist, userID, keepID string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL AND id::text <> $2
+		RETURNING id
+	`, userID, keepID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	sessionIDs := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			sessionIDs = append(sessionIDs, id)
+		}
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL AND family_id::text <> $2
+	`, userID, keepID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range sessionIDs {
+		denylist.DenySession(id)
+	}
+	return len(sessionIDs), nil
+}
+
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max])
+}
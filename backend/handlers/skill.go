@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
 	"github.com/gili/backend/models"
 	"github.com/gofiber/fiber/v2"
 )
@@ -18,7 +19,7 @@ func NewSkillHandler(db *sql.DB, cfg *config.Config) *SkillHandler {
 }
 
 func (h *SkillHandler) GetProgress(c *fiber.Ctx) error {
-	userID := c.Locals("userID").(string)
+	userID := middleware.SubjectUserID(c)
 
 	// Get skill progress
 	rows, err := h.db.Query(`
@@ -69,14 +70,14 @@ func (h *SkillHandler) GetProgress(c *fiber.Ctx) error {
 }
 
 func (h *SkillHandler) GetPortfolio(c *fiber.Ctx) error {
-	userID := c.Locals("userID").(string)
+	userID := middleware.SubjectUserID(c)
 
 	// Get completed stories as portfolio items
 	rows, err := h.db.Query(`
 		SELECT s.id, s.prompt_title, s.created_at, f.overall_score
 		FROM stories s
 		LEFT JOIN story_feedback f ON s.id = f.story_id
-		WHERE s.user_id = $1 AND s.status = 'completed'
+		WHERE s.user_id = $1 AND s.status = 'completed' AND s.deleted_at IS NULL
 		ORDER BY s.created_at DESC
 		LIMIT 50
 	`, userID)
@@ -124,7 +125,7 @@ func (h *SkillHandler) GetPortfolio(c *fiber.Ctx) error {
 
 	// Add achievements based on story count
 	var storyCount int
-	h.db.QueryRow("SELECT COUNT(*) FROM stories WHERE user_id = $1 AND status = 'completed'", userID).Scan(&storyCount)
+	h.db.QueryRow("SELECT COUNT(*) FROM stories WHERE user_id = $1 AND status = 'completed' AND deleted_at IS NULL", userID).Scan(&storyCount)
 
 	if storyCount >= 1 {
 		items = append(items, models.PortfolioItem{
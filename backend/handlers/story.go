@@ -2,23 +2,34 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gili/backend/config"
 	"github.com/gili/backend/database"
+	"github.com/gili/backend/middleware"
 	"github.com/gili/backend/models"
+	"github.com/gili/backend/retry"
+	"github.com/gili/backend/storage"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type StoryHandler struct {
-	db  *sql.DB
-	cfg *config.Config
-	rmq *database.RabbitMQ
+	db    *sql.DB
+	cfg   *config.Config
+	rmq   *database.RabbitMQ
+	blobs storage.BlobStore
 }
 
-func NewStoryHandler(db *sql.DB, cfg *config.Config, rmq *database.RabbitMQ) *StoryHandler {
-	return &StoryHandler{db: db, cfg: cfg, rmq: rmq}
+func NewStoryHandler(db *sql.DB, cfg *config.Config, rmq *database.RabbitMQ, blobs storage.BlobStore) *StoryHandler {
+	return &StoryHandler{db: db, cfg: cfg, rmq: rmq, blobs: blobs}
 }
 
 func (h *StoryHandler) CreateStory(c *fiber.Ctx) error {
@@ -38,6 +49,19 @@ func (h *StoryHandler) CreateStory(c *fiber.Ctx) error {
 		})
 	}
 
+	// Voice recordings of young children need a guardian's consent
+	if req.InputType == "audio" {
+		pending, err := middleware.ConsentIsPending(h.db, userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if pending {
+			return middleware.ConsentRequired(c)
+		}
+	}
+
 	// For text input, content is required
 	if req.InputType == "text" && req.Content == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -80,37 +104,156 @@ func (h *StoryHandler) CreateStory(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(story)
 }
 
+// GetStories lists the student's stories. Filters: status (comma separated),
+// input_type, prompt_id, from and to (RFC 3339, on created_at) and
+// min_score. sort is created_at (default) or score, order desc (default) or
+// asc. Page with limit and cursor, the next_cursor of the previous page;
+// ?page= switches to numbered pages with a total count, as older app
+// versions use.
 func (h *StoryHandler) GetStories(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 
-	// Pagination
-	page, _ := strconv.Atoi(c.Query("page", "1"))
-	pageSize, _ := strconv.Atoi(c.Query("page_size", "20"))
-	if page < 1 {
-		page = 1
+	from := `
+		FROM stories s
+		LEFT JOIN story_feedback f ON s.id = f.story_id
+		WHERE s.user_id = $1 AND s.deleted_at IS NULL`
+	args := []interface{}{userID}
+	argCount := 1
+
+	if statuses := c.Query("status"); statuses != "" {
+		list := []string{}
+		for _, st := range strings.Split(statuses, ",") {
+			if st = strings.TrimSpace(st); st != "" {
+				list = append(list, st)
+			}
+		}
+		argCount++
+		from += fmt.Sprintf(" AND s.status = ANY($%d)", argCount)
+		args = append(args, pq.Array(list))
+	}
+
+	if v := c.Query("input_type"); v != "" {
+		if v != "audio" && v != "text" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "input_type must be 'audio' or 'text'",
+			})
+		}
+		argCount++
+		from += fmt.Sprintf(" AND s.input_type = $%d", argCount)
+		args = append(args, v)
 	}
+
+	if v := c.Query("prompt_id"); v != "" {
+		argCount++
+		from += fmt.Sprintf(" AND s.prompt_id = $%d", argCount)
+		args = append(args, v)
+	}
+
+	for _, f := range []struct{ param, op string }{
+		{"from", ">="},
+		{"to", "<"},
+	} {
+		v := c.Query(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("%s must be an RFC 3339 timestamp", f.param),
+			})
+		}
+		argCount++
+		from += fmt.Sprintf(" AND s.created_at %s $%d", f.op, argCount)
+		args = append(args, t.UTC())
+	}
+
+	if v := c.Query("min_score"); v != "" {
+		minScore, err := strconv.Atoi(v)
+		if err != nil || minScore < 0 || minScore > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "min_score must be between 0 and 100",
+			})
+		}
+		argCount++
+		from += fmt.Sprintf(" AND f.overall_score >= $%d", argCount)
+		args = append(args, minScore)
+	}
+
+	sort := c.Query("sort", "created_at")
+	if sort != "created_at" && sort != "score" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "sort must be 'created_at' or 'score'",
+		})
+	}
+	order := c.Query("order", "desc")
+	if order != "desc" && order != "asc" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order must be 'desc' or 'asc'",
+		})
+	}
+
+	// Keys are unique with the ID last, so pages never overlap or skip.
+	// Unscored stories sort as -1.
+	keys := []string{"s.created_at", "s.id"}
+	if sort == "score" {
+		keys = append([]string{"COALESCE(f.overall_score, -1)"}, keys...)
+	}
+	key := strings.Join(keys, ", ")
+	direction, cmp := "DESC", "<"
+	if order == "asc" {
+		direction, cmp = "ASC", ">"
+	}
+
+	pageSize, _ := strconv.Atoi(c.Query("limit", c.Query("page_size", "20")))
 	if pageSize < 1 || pageSize > 50 {
 		pageSize = 20
 	}
-	offset := (page - 1) * pageSize
 
-	// Get total count
-	var totalCount int
-	h.db.QueryRow("SELECT COUNT(*) FROM stories WHERE user_id = $1", userID).Scan(&totalCount)
+	resp := models.StoryListResponse{PageSize: pageSize}
+	var cursorClause string
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeStoryCursor(v)
+		if err != nil || cur.Sort != sort || cur.Order != order {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+		if sort == "score" {
+			argCount += 3
+			cursorClause = fmt.Sprintf(" AND (%s) %s ($%d, $%d, $%d)", key, cmp, argCount-2, argCount-1, argCount)
+			args = append(args, cur.Score, cur.CreatedAt, cur.ID)
+		} else {
+			argCount += 2
+			cursorClause = fmt.Sprintf(" AND (%s) %s ($%d, $%d)", key, cmp, argCount-1, argCount)
+			args = append(args, cur.CreatedAt, cur.ID)
+		}
+	} else if c.Query("page") != "" {
+		page, _ := strconv.Atoi(c.Query("page"))
+		if page < 1 {
+			page = 1
+		}
+		var totalCount int
+		h.db.QueryRow("SELECT COUNT(*)"+from, args...).Scan(&totalCount)
+		resp.Page = page
+		resp.TotalCount = &totalCount
+		cursorClause = fmt.Sprintf(" OFFSET %d", (page-1)*pageSize)
+	}
 
-	// Get stories
-	rows, err := h.db.Query(`
-		SELECT s.id, s.user_id, s.prompt_id, s.prompt_title, s.input_type, s.content, 
+	orderBy := strings.Join(keys, " "+direction+", ") + " " + direction
+	query := `
+		SELECT s.id, s.user_id, s.prompt_id, s.prompt_title, s.input_type, s.content,
 		       s.audio_url, s.transcript, s.status, s.created_at, s.updated_at,
-		       f.id, f.clarity_score, f.structure_score, f.creativity_score, 
-		       f.expression_score, f.overall_score, f.feedback_text
-		FROM stories s
-		LEFT JOIN story_feedback f ON s.id = f.story_id
-		WHERE s.user_id = $1
-		ORDER BY s.created_at DESC
-		LIMIT $2 OFFSET $3
-	`, userID, pageSize, offset)
+		       f.id, f.clarity_score, f.structure_score, f.creativity_score,
+		       f.expression_score, f.overall_score, f.feedback_text` + from
+	if resp.Page > 0 {
+		query += fmt.Sprintf(" ORDER BY %s LIMIT %d%s", orderBy, pageSize, cursorClause)
+	} else {
+		// One extra row tells whether there is a next page
+		query += fmt.Sprintf("%s ORDER BY %s LIMIT %d", cursorClause, orderBy, pageSize+1)
+	}
 
+	rows, err := h.db.Query(query, args...)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch stories",
@@ -151,12 +294,47 @@ func (h *StoryHandler) GetStories(c *fiber.Ctx) error {
 		stories = append(stories, story)
 	}
 
-	return c.JSON(models.StoryListResponse{
-		Stories:    stories,
-		TotalCount: totalCount,
-		Page:       page,
-		PageSize:   pageSize,
-	})
+	if resp.Page == 0 && len(stories) > pageSize {
+		stories = stories[:pageSize]
+		next := encodeStoryCursor(sort, order, stories[pageSize-1])
+		resp.NextCursor = &next
+	}
+	resp.Stories = stories
+
+	return c.JSON(resp)
+}
+
+// storyCursor is the sort key of the last story on a page.
+type storyCursor struct {
+	Sort      string    `json:"s"`
+	Order     string    `json:"o"`
+	Score     int       `json:"sc,omitempty"`
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeStoryCursor(sort, order string, story models.Story) string {
+	cur := storyCursor{Sort: sort, Order: order, Score: -1, CreatedAt: story.CreatedAt, ID: story.ID}
+	if story.Feedback != nil {
+		cur.Score = story.Feedback.OverallScore
+	}
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeStoryCursor(s string) (storyCursor, error) {
+	var cur storyCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return cur, err
+	}
+	if _, err := uuid.Parse(cur.ID); err != nil {
+		return cur, err
+	}
+	return cur, nil
 }
 
 func (h *StoryHandler) GetStory(c *fiber.Ctx) error {
@@ -166,12 +344,13 @@ func (h *StoryHandler) GetStory(c *fiber.Ctx) error {
 	var story models.Story
 	err := h.db.QueryRow(`
 		SELECT id, user_id, prompt_id, prompt_title, input_type, content, 
-		       audio_url, transcript, status, created_at, updated_at
-		FROM stories WHERE id = $1 AND user_id = $2
+		       audio_url, audio_duration_ms, transcript, status, revision, attempts, next_retry_at,
+		       created_at, updated_at
+		FROM stories WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
 	`, storyID, userID).Scan(
 		&story.ID, &story.UserID, &story.PromptID, &story.PromptTitle,
-		&story.InputType, &story.Content, &story.AudioURL, &story.Transcript,
-		&story.Status, &story.CreatedAt, &story.UpdatedAt,
+		&story.InputType, &story.Content, &story.AudioURL, &story.AudioDurationMs, &story.Transcript,
+		&story.Status, &story.Revision, &story.Attempts, &story.NextRetryAt, &story.CreatedAt, &story.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -203,14 +382,91 @@ func (h *StoryHandler) GetStory(c *fiber.Ctx) error {
 	return c.JSON(story)
 }
 
-func (h *StoryHandler) GetTimeline(c *fiber.Ctx) error {
+// manualRetryInterval is how long a student waits after a failure before
+// retrying a story.
+const manualRetryInterval = 5 * time.Minute
+
+// maxManualRetries is how many attempts beyond cfg.StoryMaxAttempts a student
+// may ask for at each stage.
+const maxManualRetries = 3
+
+// RetryStory requeues one of the student's stories whose transcription or
+// evaluation failed, whether or not automatic retries are left, at most once
+// per manualRetryInterval and maxManualRetries times beyond the automatic ones.
+func (h *StoryHandler) RetryStory(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+
+	var status string
+	var attempts int
+	var sinceUpdate float64
+	err := h.db.QueryRow(`
+		SELECT status, attempts, EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - updated_at)
+		FROM stories WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+	`, storyID, userID).Scan(&status, &attempts, &sinceUpdate)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	maxAttempts := h.cfg.StoryMaxAttempts + maxManualRetries
+	if status == "failed" || status == "transcription_failed" {
+		if attempts >= maxAttempts {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":  "This story has been retried too many times",
+				"status": status,
+			})
+		}
+		if wait := manualRetryInterval - time.Duration(sinceUpdate*float64(time.Second)); wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":       "Please wait before retrying this story",
+				"retry_after": seconds,
+			})
+		}
+	}
+
+	newStatus, err := retry.RequeueManual(h.db, h.rmq, storyID, manualRetryInterval, maxAttempts)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Only failed stories can be retried",
+			"status": status,
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retry story",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"id":          storyID,
+		"status":      newStatus,
+		"description": getStatusDescription(newStatus, false),
+	})
+}
+
+func (h *StoryHandler) GetTimeline(c *fiber.Ctx) error {
+	userID := middleware.SubjectUserID(c)
 
 	rows, err := h.db.Query(`
-		SELECT s.id, s.prompt_title, s.status, s.created_at, f.overall_score
+		SELECT s.id, s.prompt_title, s.status, s.next_retry_at IS NOT NULL, s.created_at, f.overall_score
 		FROM stories s
 		LEFT JOIN story_feedback f ON s.id = f.story_id
-		WHERE s.user_id = $1
+		WHERE s.user_id = $1 AND s.deleted_at IS NULL
 		ORDER BY s.created_at DESC
 		LIMIT 50
 	`, userID)
@@ -225,11 +481,12 @@ func (h *StoryHandler) GetTimeline(c *fiber.Ctx) error {
 	items := []models.TimelineItem{}
 	for rows.Next() {
 		var id, status string
+		var retrying bool
 		var promptTitle sql.NullString
 		var createdAt sql.NullTime
 		var overallScore sql.NullInt64
 
-		if err := rows.Scan(&id, &promptTitle, &status, &createdAt, &overallScore); err != nil {
+		if err := rows.Scan(&id, &promptTitle, &status, &retrying, &createdAt, &overallScore); err != nil {
 			continue
 		}
 
@@ -242,7 +499,7 @@ func (h *StoryHandler) GetTimeline(c *fiber.Ctx) error {
 			ID:          id,
 			Type:        "story",
 			Title:       title,
-			Description: getStatusDescription(status),
+			Description: getStatusDescription(status, retrying),
 			Status:      status,
 		}
 
@@ -285,8 +542,19 @@ func nullString(s string) sql.NullString {
 	return sql.NullString{String: s, Valid: true}
 }
 
-func getStatusDescription(status string) string {
+// getStatusDescription describes a story's status to the student. retrying
+// says whether a failed story will be retried automatically.
+func getStatusDescription(status string, retrying bool) string {
 	switch status {
+	case "pending_transcription":
+		return "Menunggu rekaman diubah menjadi teks"
+	case "transcribing":
+		return "Rekaman sedang diubah menjadi teks"
+	case "transcription_failed":
+		if retrying {
+			return "Rekaman belum bisa diubah menjadi teks, akan dicoba lagi"
+		}
+		return "Rekaman tidak bisa diubah menjadi teks, kamu bisa mencobanya lagi"
 	case "pending":
 		return "Menunggu evaluasi AI"
 	case "processing":
@@ -294,7 +562,10 @@ func getStatusDescription(status string) string {
 	case "completed":
 		return "Evaluasi selesai"
 	case "failed":
-		return "Evaluasi gagal, akan dicoba lagi"
+		if retrying {
+			return "Evaluasi gagal, akan dicoba lagi"
+		}
+		return "Evaluasi gagal, kamu bisa mencobanya lagi"
 	default:
 		return ""
 	}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/audio"
+	"github.com/gili/backend/models"
+	"github.com/gili/backend/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var (
+	errAudioTooShort = errors.New("recording is too short")
+	errAudioTooLong  = errors.New("recording is too long")
+	errStoryExists   = errors.New("story already exists")
+)
+
+// UploadAudioStory creates an audio story from a multipart upload. The
+// recording goes in the "audio" field, with optional prompt_id and
+// prompt_title fields.
+func (h *StoryHandler) UploadAudioStory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	file, err := c.FormFile("audio")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "An audio file is required in the 'audio' field",
+		})
+	}
+	if file.Size > h.cfg.AudioMaxSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error":    "Recording is too large",
+			"max_size": h.cfg.AudioMaxSize,
+		})
+	}
+
+	promptID := c.FormValue("prompt_id")
+	promptTitle := c.FormValue("prompt_title")
+	if len(promptID) > 50 || len(promptTitle) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "prompt_id or prompt_title is too long",
+		})
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read upload",
+		})
+	}
+	defer f.Close()
+
+	story, err := h.createAudioStory(c.Context(), userID, "", promptID, promptTitle, nil, f, file.Size)
+	if err != nil {
+		return h.audioRejected(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(story)
+}
+
+// createAudioStory checks a recording, stores it and creates a story for it,
+// queued for transcription (see package transcribe) and then evaluation.
+// storyID and recordedAt are set for recordings made offline; otherwise the
+// story gets a new ID and the current time.
+func (h *StoryHandler) createAudioStory(ctx context.Context, userID, storyID, promptID, promptTitle string, recordedAt *time.Time, r io.ReaderAt, size int64) (*models.Story, error) {
+	info, err := audio.Probe(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if info.Duration < h.cfg.AudioMinDuration {
+		return nil, errAudioTooShort
+	}
+	if info.Duration > h.cfg.AudioMaxDuration {
+		return nil, errAudioTooLong
+	}
+
+	blobName := storyID
+	if storyID == "" {
+		storyID = uuid.New().String()
+		blobName = storyID
+	} else {
+		// A replayed upload must not overwrite the recording of the story
+		// that already has this ID
+		blobName = storyID + "-" + uuid.New().String()[:8]
+	}
+	key := "stories/" + userID + "/" + blobName + info.Extension
+	if err := h.blobs.Put(ctx, key, io.NewSectionReader(r, 0, size), size, info.MIMEType); err != nil {
+		return nil, fmt.Errorf("store recording: %w", err)
+	}
+
+	audioURL := strings.TrimSuffix(h.cfg.PublicAPIURL, "/") + "/api/v1/stories/" + storyID + "/audio"
+	durationMs := int(info.Duration.Milliseconds())
+
+	var story models.Story
+	err = h.db.QueryRow(`
+		INSERT INTO stories (id, user_id, prompt_id, prompt_title, input_type, audio_url,
+		                     audio_key, audio_content_type, audio_duration_ms, audio_size_bytes, status, created_at)
+		VALUES ($1, $2, $3, $4, 'audio', $5, $6, $7, $8, $9, 'pending_transcription', COALESCE($10, CURRENT_TIMESTAMP))
+		RETURNING id, user_id, prompt_id, prompt_title, input_type, audio_url, audio_duration_ms,
+		          status, created_at, updated_at
+	`, storyID, userID, nullString(promptID), nullString(promptTitle), audioURL,
+		key, info.MIMEType, durationMs, size, recordedAt,
+	).Scan(
+		&story.ID, &story.UserID, &story.PromptID, &story.PromptTitle, &story.InputType,
+		&story.AudioURL, &story.AudioDurationMs, &story.Status, &story.CreatedAt, &story.UpdatedAt,
+	)
+	if err != nil {
+		// Don't leave an orphaned recording behind
+		h.blobs.Delete(context.Background(), key)
+		if isUniqueViolation(err) {
+			return nil, errStoryExists
+		}
+		return nil, fmt.Errorf("create story: %w", err)
+	}
+
+	// Speech-to-text runs async as well (ADR-002); the transcription worker
+	// queues the story for evaluation afterwards
+	if h.rmq != nil {
+		if err := h.rmq.PublishStoryTranscription(storyID); err != nil {
+			log.Printf("Warning: failed to queue story %s for transcription: %v", storyID, err)
+		}
+	}
+
+	return &story, nil
+}
+
+// audioInvalid reports whether createAudioStory rejected the recording
+// itself (or its story ID was taken), as opposed to failing to store it.
+func audioInvalid(err error) bool {
+	return errors.Is(err, audio.ErrUnsupportedFormat) || errors.Is(err, audio.ErrUnknownDuration) ||
+		errors.Is(err, errAudioTooShort) || errors.Is(err, errAudioTooLong) ||
+		errors.Is(err, errStoryExists)
+}
+
+// audioRejected reports why createAudioStory failed.
+func (h *StoryHandler) audioRejected(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errStoryExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Story has already been uploaded",
+		})
+	case errors.Is(err, audio.ErrUnsupportedFormat):
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Recording must be WAV, M4A/AAC, WebM, Ogg or MP3",
+		})
+	case errors.Is(err, audio.ErrUnknownDuration):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Recording appears to be damaged or incomplete",
+		})
+	case errors.Is(err, errAudioTooShort), errors.Is(err, errAudioTooLong):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":                "Recording length is out of range",
+			"min_duration_seconds": h.cfg.AudioMinDuration.Seconds(),
+			"max_duration_seconds": h.cfg.AudioMaxDuration.Seconds(),
+		})
+	}
+
+	log.Printf("Failed to create audio story: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to create story",
+	})
+}
+
+// GetStoryAudio streams the recording of one of the user's stories.
+func (h *StoryHandler) GetStoryAudio(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Recording not found",
+		})
+	}
+
+	var key, contentType string
+	err := h.db.QueryRow(`
+		SELECT audio_key, COALESCE(audio_content_type, 'application/octet-stream')
+		FROM stories WHERE id = $1 AND user_id = $2 AND audio_key IS NOT NULL AND deleted_at IS NULL
+	`, storyID, userID).Scan(&key, &contentType)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Recording not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	body, size, err := h.blobs.Get(c.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Recording not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read recording",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+	// fasthttp closes the body once it has been sent
+	return c.SendStream(body, int(size))
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// DeleteStory hides one of the student's stories at once. Its feedback and
+// recordings are kept until STORY_RESTORE_WINDOW has passed, when the privacy
+// worker removes them; until then RestoreStory brings the story back. What
+// the story added to skill progress is taken off immediately.
+func (h *StoryHandler) DeleteStory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`
+		SELECT status FROM stories WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL FOR UPDATE
+	`, storyID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// A worker holding the story could still add its scores to skill
+	// progress after they have been taken off
+	if status == "processing" || status == "transcribing" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Story is being processed, try again in a moment",
+			"status": status,
+		})
+	}
+
+	if err := adjustSkillProgress(tx, storyID, userID, -1); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete story",
+		})
+	}
+
+	var deletedAt time.Time
+	err = tx.QueryRow(`
+		UPDATE stories SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING deleted_at
+	`, storyID).Scan(&deletedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete story",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete story",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":            storyID,
+		"deleted_at":    deletedAt,
+		"restore_until": deletedAt.Add(h.cfg.StoryRestoreWindow),
+	})
+}
+
+// RestoreStory undoes DeleteStory within the restore window. Stories deleted
+// while waiting for transcription or evaluation are queued again.
+func (h *StoryHandler) RestoreStory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	var deletedAt time.Time
+	err = tx.QueryRow(`
+		SELECT deleted_at FROM stories WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL FOR UPDATE
+	`, storyID, userID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Deleted story not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if time.Since(deletedAt) > h.cfg.StoryRestoreWindow {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Story can no longer be restored",
+		})
+	}
+
+	if err := adjustSkillProgress(tx, storyID, userID, 1); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to restore story",
+		})
+	}
+
+	var story models.Story
+	err = tx.QueryRow(`
+		UPDATE stories SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING id, user_id, prompt_id, prompt_title, input_type, content, audio_url,
+		          audio_duration_ms, transcript, status, revision, attempts, created_at, updated_at
+	`, storyID).Scan(
+		&story.ID, &story.UserID, &story.PromptID, &story.PromptTitle,
+		&story.InputType, &story.Content, &story.AudioURL, &story.AudioDurationMs, &story.Transcript,
+		&story.Status, &story.Revision, &story.Attempts, &story.CreatedAt, &story.UpdatedAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to restore story",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to restore story",
+		})
+	}
+
+	if h.rmq != nil {
+		switch story.Status {
+		case "pending":
+			err = h.rmq.PublishStoryEvaluation(storyID)
+		case "pending_transcription":
+			err = h.rmq.PublishStoryTranscription(storyID)
+		}
+		if err != nil {
+			// The workers' sweeps pick up stories left waiting
+			log.Printf("Warning: failed to requeue restored story %s: %v", storyID, err)
+		}
+	}
+
+	return c.JSON(story)
+}
+
+// GetDeletedStories lists the student's deleted stories that can still be
+// restored, most recently deleted first.
+func (h *StoryHandler) GetDeletedStories(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	rows, err := h.db.Query(`
+		SELECT id, user_id, prompt_id, prompt_title, input_type, status, revision,
+		       deleted_at, created_at, updated_at
+		FROM stories
+		WHERE user_id = $1 AND deleted_at > $2
+		ORDER BY deleted_at DESC
+		LIMIT 50
+	`, userID, time.Now().Add(-h.cfg.StoryRestoreWindow))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch deleted stories",
+		})
+	}
+	defer rows.Close()
+
+	stories := []models.Story{}
+	for rows.Next() {
+		var story models.Story
+		err := rows.Scan(
+			&story.ID, &story.UserID, &story.PromptID, &story.PromptTitle,
+			&story.InputType, &story.Status, &story.Revision,
+			&story.DeletedAt, &story.CreatedAt, &story.UpdatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		restoreUntil := story.DeletedAt.Add(h.cfg.StoryRestoreWindow)
+		story.RestoreUntil = &restoreUntil
+		stories = append(stories, story)
+	}
+
+	return c.JSON(fiber.Map{
+		"stories": stories,
+	})
+}
+
+// adjustSkillProgress takes a story's contribution off the student's skill
+// progress (sign -1) or adds it back (sign 1). Only the story's first
+// evaluation counts towards progress: the earliest scored revision, or the
+// current feedback if no earlier revision was scored. Scores count the way
+// the AI worker does: a tenth of the matching score per skill, a level every
+// 100 points.
+func adjustSkillProgress(tx *sql.Tx, storyID, userID string, sign int) error {
+	_, err := tx.Exec(`
+		WITH first_revision AS (
+			SELECT clarity_score, structure_score, creativity_score, expression_score
+			FROM story_revisions
+			WHERE story_id = $1 AND overall_score IS NOT NULL
+			ORDER BY revision
+			LIMIT 1
+		), scored AS (
+			SELECT * FROM first_revision
+			UNION ALL
+			SELECT clarity_score, structure_score, creativity_score, expression_score
+			FROM story_feedback
+			WHERE story_id = $1 AND NOT EXISTS (SELECT 1 FROM first_revision)
+		), gains AS (
+			SELECT sk.id AS skill_id,
+			       CASE sk.name
+			           WHEN 'Kejelasan Bertutur' THEN scored.clarity_score
+			           WHEN 'Alur Cerita' THEN scored.structure_score
+			           WHEN 'Ekspresi Perasaan' THEN scored.expression_score
+			           WHEN 'Kreativitas' THEN scored.creativity_score
+			       END / 10 AS gain
+			FROM scored CROSS JOIN skills sk
+			WHERE sk.name IN ('Kejelasan Bertutur', 'Alur Cerita', 'Ekspresi Perasaan', 'Kreativitas')
+		), totals AS (
+			SELECT sp.id, GREATEST((sp.level - 1) * 100 + sp.progress + $3 * COALESCE(g.gain, 0), 0) AS points
+			FROM skill_progress sp JOIN gains g ON g.skill_id = sp.skill_id
+			WHERE sp.user_id = $2
+		)
+		UPDATE skill_progress sp
+		SET level = t.points / 100 + 1, progress = t.points % 100,
+		    total_stories = GREATEST(sp.total_stories + $3, 0), updated_at = CURRENT_TIMESTAMP
+		FROM totals t
+		WHERE sp.id = t.id
+	`, storyID, userID, sign)
+	return err
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// UpdateStory rewrites one of the student's stories. The current version and
+// its feedback move to story_revisions and the new text is queued for
+// evaluation as the next revision. Only stories that are done being
+// processed can be rewritten; a rewrite is always text.
+func (h *StoryHandler) UpdateStory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+
+	var req models.UpdateStoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Content is required",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`
+		SELECT status FROM stories WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL FOR UPDATE
+	`, storyID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	switch status {
+	case "completed", "failed", "transcription_failed":
+	default:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Story is still being processed",
+			"status": status,
+		})
+	}
+
+	// The recording of an audio revision stays in blob storage with its
+	// revision until the story is deleted
+	_, err = tx.Exec(`
+		INSERT INTO story_revisions (
+			story_id, revision, input_type, content, transcript, audio_key, audio_duration_ms, status,
+			clarity_score, structure_score, creativity_score, expression_score, overall_score,
+			feedback_text, strengths, improvements, submitted_at, evaluated_at
+		)
+		SELECT s.id, s.revision, s.input_type, s.content, s.transcript, s.audio_key, s.audio_duration_ms, s.status,
+		       f.clarity_score, f.structure_score, f.creativity_score, f.expression_score, f.overall_score,
+		       f.feedback_text, f.strengths, f.improvements, COALESCE(s.revised_at, s.created_at), f.created_at
+		FROM stories s
+		LEFT JOIN story_feedback f ON f.story_id = s.id
+		WHERE s.id = $1
+	`, storyID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save revision",
+		})
+	}
+
+	if _, err := tx.Exec("DELETE FROM story_feedback WHERE story_id = $1", storyID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save revision",
+		})
+	}
+
+	var story models.Story
+	err = tx.QueryRow(`
+		UPDATE stories
+		SET revision = revision + 1, revised_at = CURRENT_TIMESTAMP,
+		    input_type = 'text', content = $1, transcript = NULL,
+		    audio_url = NULL, audio_key = NULL, audio_content_type = NULL,
+		    audio_duration_ms = NULL, audio_size_bytes = NULL,
+		    status = 'pending', attempts = 0, last_error = NULL, next_retry_at = NULL,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+		RETURNING id, user_id, prompt_id, prompt_title, input_type, content, status, revision,
+		          attempts, created_at, updated_at
+	`, req.Content, storyID).Scan(
+		&story.ID, &story.UserID, &story.PromptID, &story.PromptTitle,
+		&story.InputType, &story.Content, &story.Status, &story.Revision,
+		&story.Attempts, &story.CreatedAt, &story.UpdatedAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save revision",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save revision",
+		})
+	}
+
+	if h.rmq != nil {
+		if err := h.rmq.PublishStoryEvaluation(storyID); err != nil {
+			// The retry worker republishes stories left pending
+			log.Printf("Warning: failed to queue story %s for evaluation: %v", storyID, err)
+		}
+	}
+
+	return c.JSON(story)
+}
+
+// GetStoryRevisions lists every revision of a story, oldest first, with the
+// change in each score from the previous evaluated revision. The comparison
+// spans the first and latest evaluated revisions unless ?from= and ?to= pick
+// two others.
+func (h *StoryHandler) GetStoryRevisions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	storyID := c.Params("id")
+
+	if _, err := uuid.Parse(storyID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+
+	var current models.StoryRevision
+	var createdAt sql.NullTime
+	var scores [5]sql.NullInt64
+	err := h.db.QueryRow(`
+		SELECT s.revision, s.input_type, s.content, s.transcript, s.status,
+		       COALESCE(s.revised_at, s.created_at),
+		       f.clarity_score, f.structure_score, f.creativity_score, f.expression_score, f.overall_score,
+		       f.feedback_text
+		FROM stories s
+		LEFT JOIN story_feedback f ON f.story_id = s.id
+		WHERE s.id = $1 AND s.user_id = $2 AND s.deleted_at IS NULL
+	`, storyID, userID).Scan(
+		&current.Revision, &current.InputType, &current.Content, &current.Transcript, &current.Status,
+		&createdAt, &scores[0], &scores[1], &scores[2], &scores[3], &scores[4], &current.FeedbackText,
+	)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Story not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	current.SubmittedAt = createdAt.Time
+	current.Scores = revisionScores(scores)
+	current.Current = true
+
+	rows, err := h.db.Query(`
+		SELECT revision, input_type, content, transcript, status, submitted_at,
+		       clarity_score, structure_score, creativity_score, expression_score, overall_score,
+		       feedback_text
+		FROM story_revisions
+		WHERE story_id = $1
+		ORDER BY revision
+	`, storyID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch revisions",
+		})
+	}
+	defer rows.Close()
+
+	revisions := []models.StoryRevision{}
+	for rows.Next() {
+		var rev models.StoryRevision
+		err := rows.Scan(
+			&rev.Revision, &rev.InputType, &rev.Content, &rev.Transcript, &rev.Status, &rev.SubmittedAt,
+			&scores[0], &scores[1], &scores[2], &scores[3], &scores[4], &rev.FeedbackText,
+		)
+		if err != nil {
+			continue
+		}
+		rev.Scores = revisionScores(scores)
+		revisions = append(revisions, rev)
+	}
+	revisions = append(revisions, current)
+
+	// Deltas skip revisions that were never evaluated
+	var prev *models.StoryScores
+	for i := range revisions {
+		if revisions[i].Scores == nil {
+			continue
+		}
+		if prev != nil {
+			delta := revisions[i].Scores.Sub(*prev)
+			revisions[i].Delta = &delta
+		}
+		prev = revisions[i].Scores
+	}
+
+	comparison, errMsg := compareRevisions(revisions, c.Query("from"), c.Query("to"))
+	if errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	return c.JSON(models.StoryRevisionsResponse{
+		StoryID:    storyID,
+		Revisions:  revisions,
+		Comparison: comparison,
+	})
+}
+
+// revisionScores returns nil unless the revision has been evaluated.
+func revisionScores(s [5]sql.NullInt64) *models.StoryScores {
+	if !s[4].Valid {
+		return nil
+	}
+	return &models.StoryScores{
+		Clarity:    int(s[0].Int64),
+		Structure:  int(s[1].Int64),
+		Creativity: int(s[2].Int64),
+		Expression: int(s[3].Int64),
+		Overall:    int(s[4].Int64),
+	}
+}
+
+// compareRevisions compares the revisions numbered from and to, defaulting to
+// the first and latest evaluated ones. It returns nil when fewer than two
+// revisions have been evaluated, and an error message for bad parameters.
+func compareRevisions(revisions []models.StoryRevision, from, to string) (*models.RevisionComparison, string) {
+	evaluated := map[int]*models.StoryScores{}
+	first, last := 0, 0
+	for _, rev := range revisions {
+		if rev.Scores == nil {
+			continue
+		}
+		evaluated[rev.Revision] = rev.Scores
+		if first == 0 {
+			first = rev.Revision
+		}
+		last = rev.Revision
+	}
+
+	pick := func(param string, def int) (int, string) {
+		if param == "" {
+			return def, ""
+		}
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			return 0, "Revision numbers must be integers"
+		}
+		if evaluated[n] == nil {
+			return 0, "Revision " + param + " does not exist or has not been evaluated"
+		}
+		return n, ""
+	}
+
+	fromRev, errMsg := pick(from, first)
+	if errMsg != "" {
+		return nil, errMsg
+	}
+	toRev, errMsg := pick(to, last)
+	if errMsg != "" {
+		return nil, errMsg
+	}
+	if fromRev == 0 || toRev == 0 || fromRev == toRev {
+		return nil, ""
+	}
+
+	return &models.RevisionComparison{
+		From:  fromRev,
+		To:    toRev,
+		Delta: evaluated[toRev].Sub(*evaluated[fromRev]),
+	}, ""
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Snippets are highlighted with control characters, which are removed from
+// the text beforehand, and become <mark> tags once the text is HTML-escaped.
+const (
+	headlineStart = "\x01"
+	headlineStop  = "\x02"
+)
+
+// headlineOptions configures the snippets returned by SearchStories.
+const headlineOptions = "StartSel=\"" + headlineStart + "\", StopSel=\"" + headlineStop + "\", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=\" … \""
+
+var headlineMarks = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// headlineHTML escapes a ts_headline snippet and turns its markers into
+// <mark> tags, so that story text is never returned as markup.
+func headlineHTML(snippet string) string {
+	return headlineMarks.Replace(html.EscapeString(snippet))
+}
+
+// SearchStories finds the student's stories by prompt title, text,
+// transcript and feedback, best matches first. q accepts web search syntax:
+// "quoted phrases", OR and -excluded words.
+func (h *StoryHandler) SearchStories(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query is required",
+		})
+	}
+	if len(q) > 200 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query is too long",
+		})
+	}
+
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	pageSize, _ := strconv.Atoi(c.Query("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 50 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	// Snippets are built for the returned page only
+	rows, err := h.db.Query(`
+		SELECT m.id, m.prompt_title, m.input_type, m.status, m.overall_score, m.rank, m.created_at,
+		       ts_headline('indonesian', translate(m.body, $6, ''), q, $5),
+		       CASE WHEN m.feedback_matches THEN ts_headline('indonesian', translate(m.feedback_text, $6, ''), q, $5) END
+		FROM (
+			SELECT s.id, s.prompt_title, s.input_type, s.status, s.created_at, f.overall_score,
+			       COALESCE(NULLIF(s.content, ''), s.transcript, s.prompt_title, '') AS body,
+			       f.feedback_text, COALESCE(f.search_vector @@ q, false) AS feedback_matches,
+			       ts_rank_cd(s.search_vector || COALESCE(f.search_vector, ''::tsvector), q) AS rank
+			FROM stories s
+			LEFT JOIN story_feedback f ON f.story_id = s.id,
+			     websearch_to_tsquery('indonesian', $2) q
+			WHERE s.user_id = $1 AND s.deleted_at IS NULL
+			  AND (s.search_vector @@ q OR f.search_vector @@ q)
+			ORDER BY rank DESC, s.created_at DESC
+			LIMIT $3 OFFSET $4
+		) m, websearch_to_tsquery('indonesian', $2) q
+		ORDER BY m.rank DESC, m.created_at DESC
+	`, userID, q, pageSize, offset, headlineOptions, headlineStart+headlineStop)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search stories",
+		})
+	}
+	defer rows.Close()
+
+	results := []models.StorySearchResult{}
+	for rows.Next() {
+		var r models.StorySearchResult
+		err := rows.Scan(
+			&r.ID, &r.PromptTitle, &r.InputType, &r.Status, &r.OverallScore, &r.Rank, &r.CreatedAt,
+			&r.Snippet, &r.FeedbackSnippet,
+		)
+		if err != nil {
+			continue
+		}
+		r.Snippet = headlineHTML(r.Snippet)
+		if r.FeedbackSnippet != nil {
+			snippet := headlineHTML(*r.FeedbackSnippet)
+			r.FeedbackSnippet = &snippet
+		}
+		results = append(results, r)
+	}
+
+	return c.JSON(models.StorySearchResponse{
+		Query:    q,
+		Results:  results,
+		Page:     page,
+		PageSize: pageSize,
+	})
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// maxSyncBatch is how many stories one sync request may carry.
+const maxSyncBatch = 50
+
+// SyncStories stores text stories written while the app was offline. Each
+// item carries an ID generated by the app, so a batch that is sent again
+// after a lost response creates nothing twice; every item gets its own
+// result and one bad item does not fail the others. Recordings go through
+// /uploads with the story_id in Upload-Metadata instead.
+func (h *StoryHandler) SyncStories(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req models.SyncStoriesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(req.Stories) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No stories to sync",
+		})
+	}
+	if len(req.Stories) > maxSyncBatch {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error":     "Too many stories in one batch",
+			"max_batch": maxSyncBatch,
+		})
+	}
+
+	resp := models.SyncStoriesResponse{Results: []models.SyncStoryResult{}}
+	created := []string{}
+	for _, item := range req.Stories {
+		result := h.syncStory(userID, item)
+		switch result.Result {
+		case models.SyncCreated:
+			resp.Created++
+			created = append(created, result.ID)
+		case models.SyncExists, models.SyncDeleted:
+			resp.Skipped++
+		default:
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if h.rmq != nil {
+		for _, id := range created {
+			if err := h.rmq.PublishStoryEvaluation(id); err != nil {
+				// The retry worker republishes stories left pending
+				log.Printf("Warning: failed to queue story %s for evaluation: %v", id, err)
+				break
+			}
+		}
+	}
+
+	return c.JSON(resp)
+}
+
+func (h *StoryHandler) syncStory(userID string, item models.SyncStoryItem) models.SyncStoryResult {
+	result := models.SyncStoryResult{ID: item.ID, Result: models.SyncInvalid}
+
+	if _, err := uuid.Parse(item.ID); err != nil {
+		result.Error = "id must be a UUID"
+		return result
+	}
+	if item.InputType != "text" {
+		result.Error = "Only text stories can be synced here; upload recordings via /uploads"
+		return result
+	}
+	if strings.TrimSpace(item.Content) == "" {
+		result.Error = "Content is required for text input"
+		return result
+	}
+	if len(item.PromptID) > 50 || len(item.PromptTitle) > 255 {
+		result.Error = "prompt_id or prompt_title is too long"
+		return result
+	}
+	recordedAt, err := parseRecordedAt(item.RecordedAt)
+	if err != nil {
+		result.Error = "recorded_at must be an RFC 3339 timestamp"
+		return result
+	}
+
+	err = h.db.QueryRow(`
+		INSERT INTO stories (id, user_id, prompt_id, prompt_title, input_type, content, status, created_at)
+		VALUES ($1, $2, $3, $4, 'text', $5, 'pending', COALESCE($6, CURRENT_TIMESTAMP))
+		ON CONFLICT (id) DO NOTHING
+		RETURNING status
+	`, item.ID, userID, nullString(item.PromptID), nullString(item.PromptTitle), item.Content, recordedAt,
+	).Scan(&result.Status)
+	if err == nil {
+		result.Result = models.SyncCreated
+		return result
+	}
+	if err != sql.ErrNoRows {
+		result.Result = models.SyncFailed
+		result.Error = "Failed to save story"
+		return result
+	}
+
+	result.Result, result.Status, err = h.existingStory(item.ID, userID)
+	if err != nil {
+		result.Result = models.SyncFailed
+		result.Error = "Failed to save story"
+	}
+	return result
+}
+
+// existingStory reports whether a story with a client-generated ID has
+// already been synced: SyncExists or SyncDeleted with its status if it is
+// the user's, SyncConflict if it is someone else's, and "" if there is none.
+func (h *StoryHandler) existingStory(storyID, userID string) (string, string, error) {
+	var ownerID, status string
+	var deleted bool
+	err := h.db.QueryRow(`
+		SELECT user_id, status, deleted_at IS NOT NULL FROM stories WHERE id = $1
+	`, storyID).Scan(&ownerID, &status, &deleted)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case ownerID != userID:
+		return models.SyncConflict, "", nil
+	case deleted:
+		return models.SyncDeleted, status, nil
+	default:
+		return models.SyncExists, status, nil
+	}
+}
+
+// parseRecordedAt parses when an offline story was recorded, in UTC like the
+// rest of the TIMESTAMP columns; Postgres drops the offset of a time written
+// to one. Times in the future, from a device clock that is ahead, become now.
+// An empty string gives nil.
+func parseRecordedAt(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); t.After(now) {
+		t = now
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
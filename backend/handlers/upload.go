@@ -0,0 +1,667 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/models"
+	"github.com/gili/backend/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, checksum, expiration and termination extensions, so
+// stock tus clients work against /api/v1/uploads.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,expiration,termination"
+	tusChecksums  = "sha1,sha256,md5"
+)
+
+// statusChecksumMismatch is the tus status for a chunk that fails its
+// Upload-Checksum.
+const statusChecksumMismatch = 460
+
+// maxActiveUploads limits the unfinished uploads a user can hold, each of
+// which takes storage space until it expires.
+const maxActiveUploads = 5
+
+// uploadCleanupInterval is how often expired uploads are removed.
+const uploadCleanupInterval = 10 * time.Minute
+
+// staleChunkAge is how long a chunk may stay uncommitted before it is
+// assumed to belong to a request that died.
+const staleChunkAge = time.Hour
+
+// uploadCompleteTimeout is how long one request may spend turning an upload
+// into a story before another request may try.
+const uploadCompleteTimeout = 5 * time.Minute
+
+// errUploadOffsetMoved is returned by saveChunk when another request has
+// moved the upload's offset since the chunk was checked.
+var errUploadOffsetMoved = errors.New("upload offset moved")
+
+// UploadHandler lets students upload a recording in chunks and resume after
+// a dropped connection. Each chunk is stored as its own blob and listed in
+// upload_chunks, so any API instance can take the next chunk. The last chunk
+// joins them in cfg.UploadDir and turns the upload into an audio story like
+// StoryHandler.UploadAudioStory. The offset in the database only moves from
+// where a chunk started, so of two concurrent writers one gets 409.
+type UploadHandler struct {
+	db      *sql.DB
+	cfg     *config.Config
+	blobs   storage.BlobStore
+	stories *StoryHandler
+}
+
+func NewUploadHandler(db *sql.DB, cfg *config.Config, blobs storage.BlobStore, stories *StoryHandler) *UploadHandler {
+	return &UploadHandler{db: db, cfg: cfg, blobs: blobs, stories: stories}
+}
+
+// Protocol adds the tus version to every response and rejects tus requests
+// from clients speaking another version. The JSON status endpoint (GET) is
+// not part of tus and does not need the header.
+func (h *UploadHandler) Protocol(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Method() == fiber.MethodGet {
+		return c.Next()
+	}
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Unsupported Tus-Resumable version",
+		})
+	}
+	return c.Next()
+}
+
+// GetOptions describes the server's tus support.
+func (h *UploadHandler) GetOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Checksum-Algorithm", tusChecksums)
+	c.Set("Tus-Max-Size", strconv.FormatInt(h.cfg.AudioMaxSize, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateUpload starts an upload of Upload-Length bytes. Upload-Metadata may
+// carry prompt_id and prompt_title for the story and, for recordings made
+// offline, story_id (a UUID chosen by the app) and recorded_at (RFC 3339). A
+// story_id that already has a story is answered with 409 and its
+// Upload-Story-Id, so a replayed upload is not stored twice.
+func (h *UploadHandler) CreateUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Length is required",
+		})
+	}
+	if length > h.cfg.AudioMaxSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error":    "Recording is too large",
+			"max_size": h.cfg.AudioMaxSize,
+		})
+	}
+
+	meta := parseUploadMetadata(c.Get("Upload-Metadata"))
+	promptID, promptTitle := meta["prompt_id"], meta["prompt_title"]
+	if len(promptID) > 50 || len(promptTitle) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "prompt_id or prompt_title is too long",
+		})
+	}
+	recordedAt, err := parseRecordedAt(meta["recorded_at"])
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "recorded_at must be an RFC 3339 timestamp",
+		})
+	}
+
+	clientStoryID := meta["story_id"]
+	if clientStoryID != "" {
+		if _, err := uuid.Parse(clientStoryID); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "story_id must be a UUID",
+			})
+		}
+		result, _, err := h.stories.existingStory(clientStoryID, userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		switch result {
+		case models.SyncExists, models.SyncDeleted:
+			c.Set("Upload-Story-Id", clientStoryID)
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":    "Story has already been uploaded",
+				"story_id": clientStoryID,
+			})
+		case models.SyncConflict:
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "story_id is already in use",
+			})
+		}
+	}
+
+	var active int
+	h.db.QueryRow(`
+		SELECT COUNT(*) FROM upload_sessions
+		WHERE user_id = $1 AND completed_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`, userID).Scan(&active)
+	if active >= maxActiveUploads {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many unfinished uploads; finish or delete one first",
+		})
+	}
+
+	var upload models.UploadSession
+	err = h.db.QueryRow(`
+		INSERT INTO upload_sessions (user_id, upload_length, prompt_id, prompt_title, client_story_id, recorded_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, upload_length, upload_offset, prompt_id, prompt_title, client_story_id, recorded_at,
+		          expires_at, created_at
+	`, userID, length, nullString(promptID), nullString(promptTitle), nullString(clientStoryID), recordedAt,
+		time.Now().Add(h.cfg.UploadExpiry)).Scan(
+		&upload.ID, &upload.UploadLength, &upload.UploadOffset, &upload.PromptID, &upload.PromptTitle,
+		&upload.ClientStoryID, &upload.RecordedAt, &upload.ExpiresAt, &upload.CreatedAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create upload",
+		})
+	}
+
+	c.Set(fiber.HeaderLocation, strings.TrimSuffix(h.cfg.PublicAPIURL, "/")+"/api/v1/uploads/"+upload.ID)
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.Status(fiber.StatusCreated).JSON(upload)
+}
+
+// HeadUpload reports how many bytes have been received, so a client can
+// resume from there.
+func (h *UploadHandler) HeadUpload(c *fiber.Ctx) error {
+	upload, status := h.findUpload(c)
+	if upload == nil {
+		return c.SendStatus(status)
+	}
+
+	h.setUploadHeaders(c, upload)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// GetUpload returns the upload as JSON, including the story created from it.
+func (h *UploadHandler) GetUpload(c *fiber.Ctx) error {
+	upload, status := h.findUpload(c)
+	if upload == nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+	return c.JSON(upload)
+}
+
+// PatchUpload appends a chunk at Upload-Offset. A chunk with an
+// Upload-Checksum that does not match is discarded. When the last byte
+// arrives the story is created; if that fails for a transient reason, an
+// empty PATCH at the final offset retries it.
+func (h *UploadHandler) PatchUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be application/offset+octet-stream",
+		})
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Offset is required",
+		})
+	}
+
+	var expected []byte
+	var sum hash.Hash
+	if header := c.Get("Upload-Checksum"); header != "" {
+		expected, sum = parseUploadChecksum(header)
+		if sum == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Upload-Checksum must be '<sha1|sha256|md5> <base64 digest>'",
+			})
+		}
+	}
+
+	upload, status := h.findUpload(c)
+	if upload == nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+	if offset != upload.UploadOffset {
+		h.setUploadHeaders(c, upload)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":         "Upload-Offset does not match the received bytes",
+			"upload_offset": upload.UploadOffset,
+		})
+	}
+
+	chunk := c.Body()
+	if upload.StoryID == nil && len(chunk) > 0 {
+		if offset+int64(len(chunk)) > upload.UploadLength {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": "Chunk goes past Upload-Length",
+			})
+		}
+		if sum != nil {
+			sum.Write(chunk)
+			if !bytes.Equal(sum.Sum(nil), expected) {
+				return c.Status(statusChecksumMismatch).JSON(fiber.Map{
+					"error": "Checksum mismatch",
+				})
+			}
+		}
+
+		// Progress keeps an upload alive
+		expiresAt := time.Now().Add(h.cfg.UploadExpiry)
+		err := h.saveChunk(c.Context(), upload.ID, offset, chunk, expiresAt)
+		if err == errUploadOffsetMoved {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Upload-Offset does not match the received bytes",
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to save chunk of upload %s: %v", upload.ID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save chunk",
+			})
+		}
+		upload.UploadOffset = offset + int64(len(chunk))
+		upload.ExpiresAt = expiresAt
+	}
+
+	if upload.UploadOffset == upload.UploadLength && upload.StoryID == nil {
+		if err := h.complete(c, userID, upload); err != nil {
+			return err
+		}
+		if upload.StoryID == nil {
+			// complete has already responded with the reason
+			return nil
+		}
+	}
+
+	h.setUploadHeaders(c, upload)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// complete creates the story from a fully received upload and records its
+// ID on the upload. Recordings that are not acceptable end the upload; other
+// failures leave it in place to be retried. Only one request at a time
+// completes an upload.
+func (h *UploadHandler) complete(c *fiber.Ctx, userID string, upload *models.UploadSession) error {
+	res, err := h.db.Exec(`
+		UPDATE upload_sessions SET completing_until = $1
+		WHERE id = $2 AND story_id IS NULL AND (completing_until IS NULL OR completing_until < CURRENT_TIMESTAMP)
+	`, time.Now().Add(uploadCompleteTimeout), upload.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create story",
+		})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+			"error": "Another request is creating the story for this upload",
+		})
+	}
+	release := func() {
+		h.db.Exec("UPDATE upload_sessions SET completing_until = NULL WHERE id = $1", upload.ID)
+	}
+
+	f, err := h.assemble(c.Context(), upload)
+	if err != nil {
+		release()
+		log.Printf("Failed to assemble upload %s: %v", upload.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create story",
+		})
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	var storyID, promptID, promptTitle string
+	if upload.ClientStoryID != nil {
+		storyID = *upload.ClientStoryID
+	}
+	if upload.PromptID != nil {
+		promptID = *upload.PromptID
+	}
+	if upload.PromptTitle != nil {
+		promptTitle = *upload.PromptTitle
+	}
+
+	story, err := h.stories.createAudioStory(c.Context(), userID, storyID, promptID, promptTitle, upload.RecordedAt, f, upload.UploadLength)
+	if err != nil {
+		if audioInvalid(err) {
+			h.remove(upload.ID)
+		} else {
+			release()
+		}
+		return h.stories.audioRejected(c, err)
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE upload_sessions SET story_id = $1, completed_at = CURRENT_TIMESTAMP, completing_until = NULL
+		WHERE id = $2
+	`, story.ID, upload.ID)
+	if err != nil {
+		log.Printf("Failed to mark upload %s complete: %v", upload.ID, err)
+	}
+	h.deleteChunks("SELECT id, blob_key FROM upload_chunks WHERE upload_id = $1", upload.ID)
+
+	upload.StoryID = &story.ID
+	c.Set("Upload-Story-Id", story.ID)
+	return nil
+}
+
+// DeleteUpload abandons an upload and frees its space. A story already
+// created from it is kept.
+func (h *UploadHandler) DeleteUpload(c *fiber.Ctx) error {
+	upload, status := h.findUpload(c)
+	if upload == nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+
+	h.remove(upload.ID)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// StartCleanup periodically removes expired uploads, chunks left behind by
+// uploads that no longer exist or by requests that died, and old files in
+// cfg.UploadDir. It returns immediately.
+func (h *UploadHandler) StartCleanup() {
+	go func() {
+		ticker := time.NewTicker(uploadCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.removeExpired()
+		}
+	}()
+}
+
+func (h *UploadHandler) removeExpired() {
+	if _, err := h.db.Exec(`DELETE FROM upload_sessions WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		log.Printf("Warning: failed to remove expired uploads: %v", err)
+		return
+	}
+
+	// Chunks of uploads that are gone, e.g. expired or deleted with the
+	// account, and chunks never committed by their request
+	h.deleteChunks(`
+		SELECT c.id, c.blob_key FROM upload_chunks c
+		WHERE NOT EXISTS (SELECT 1 FROM upload_sessions s WHERE s.id = c.upload_id)
+		   OR (c.committed_at IS NULL AND c.created_at < $1)
+		LIMIT 1000
+	`, time.Now().Add(-staleChunkAge))
+
+	// Files left by a request that died while assembling an upload
+	entries, err := os.ReadDir(h.cfg.UploadDir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-uploadCompleteTimeout)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && info.Mode().IsRegular() && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(h.cfg.UploadDir, e.Name()))
+		}
+	}
+}
+
+// findUpload loads the caller's upload named in the route. Without one it
+// returns the status to respond with: 404, or 410 once it has expired.
+func (h *UploadHandler) findUpload(c *fiber.Ctx) (*models.UploadSession, int) {
+	userID := c.Locals("userID").(string)
+	uploadID := c.Params("id")
+
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return nil, fiber.StatusNotFound
+	}
+
+	var upload models.UploadSession
+	var expired bool
+	err := h.db.QueryRow(`
+		SELECT id, upload_length, upload_offset, prompt_id, prompt_title, client_story_id, recorded_at,
+		       story_id, expires_at, completed_at, created_at, expires_at < CURRENT_TIMESTAMP
+		FROM upload_sessions WHERE id = $1 AND user_id = $2
+	`, uploadID, userID).Scan(
+		&upload.ID, &upload.UploadLength, &upload.UploadOffset, &upload.PromptID, &upload.PromptTitle,
+		&upload.ClientStoryID, &upload.RecordedAt, &upload.StoryID, &upload.ExpiresAt, &upload.CompletedAt, &upload.CreatedAt, &expired,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fiber.StatusNotFound
+	}
+	if err != nil {
+		return nil, fiber.StatusInternalServerError
+	}
+	if expired {
+		return nil, fiber.StatusGone
+	}
+	return &upload, fiber.StatusOK
+}
+
+func (h *UploadHandler) setUploadHeaders(c *fiber.Ctx, upload *models.UploadSession) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.StoryID != nil {
+		c.Set("Upload-Story-Id", *upload.StoryID)
+	}
+}
+
+// saveChunk stores chunk as a blob of its own and commits it at offset,
+// moving the upload's offset past it. The chunk is listed before its blob is
+// written, so that a request dying half-way leaves nothing removeExpired
+// cannot find. Chunks written after an attempt that was never committed are
+// simply committed at the same offset; the uncommitted one is never read.
+func (h *UploadHandler) saveChunk(ctx context.Context, uploadID string, offset int64, chunk []byte, expiresAt time.Time) error {
+	key := fmt.Sprintf("uploads/%s/%020d-%s", uploadID, offset, uuid.New().String()[:8])
+
+	var chunkID string
+	err := h.db.QueryRow(`
+		INSERT INTO upload_chunks (upload_id, start_offset, size, blob_key) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, uploadID, offset, len(chunk), key).Scan(&chunkID)
+	if err != nil {
+		return err
+	}
+
+	if err := h.blobs.Put(ctx, key, bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE upload_sessions SET upload_offset = $1, expires_at = $2 WHERE id = $3 AND upload_offset = $4
+	`, offset+int64(len(chunk)), expiresAt, uploadID, offset)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		h.deleteChunks("SELECT id, blob_key FROM upload_chunks WHERE id = $1", chunkID)
+		return errUploadOffsetMoved
+	}
+	if _, err := tx.Exec("UPDATE upload_chunks SET committed_at = CURRENT_TIMESTAMP WHERE id = $1", chunkID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// assemble joins the committed chunks of a fully received upload into a
+// temporary file in cfg.UploadDir. The caller closes and removes it.
+func (h *UploadHandler) assemble(ctx context.Context, upload *models.UploadSession) (*os.File, error) {
+	rows, err := h.db.Query(`
+		SELECT start_offset, size, blob_key FROM upload_chunks
+		WHERE upload_id = $1 AND committed_at IS NOT NULL
+		ORDER BY start_offset
+	`, upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	type chunk struct {
+		offset, size int64
+		key          string
+	}
+	var chunks []chunk
+	for rows.Next() {
+		var ch chunk
+		if err := rows.Scan(&ch.offset, &ch.size, &ch.key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chunks = append(chunks, ch)
+	}
+	rows.Close()
+
+	if err := os.MkdirAll(h.cfg.UploadDir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(h.cfg.UploadDir, upload.ID+"-*.part")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	var written int64
+	for _, ch := range chunks {
+		if ch.offset != written {
+			return fail(fmt.Errorf("chunk at %d, expected %d", ch.offset, written))
+		}
+		body, _, err := h.blobs.Get(ctx, ch.key)
+		if err != nil {
+			return fail(fmt.Errorf("chunk %s: %w", ch.key, err))
+		}
+		n, err := io.Copy(f, io.LimitReader(body, ch.size))
+		body.Close()
+		if err != nil {
+			return fail(err)
+		}
+		if n != ch.size {
+			return fail(fmt.Errorf("chunk %s: %d of %d bytes", ch.key, n, ch.size))
+		}
+		written += n
+	}
+	if written != upload.UploadLength {
+		return fail(fmt.Errorf("%d of %d bytes in chunks", written, upload.UploadLength))
+	}
+	return f, nil
+}
+
+// deleteChunks removes the blobs of the chunks selected by query, which
+// returns their id and blob_key, and then the chunks themselves. A chunk
+// whose blob cannot be deleted is kept for the next cleanup.
+func (h *UploadHandler) deleteChunks(query string, args ...interface{}) {
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Warning: failed to list upload chunks: %v", err)
+		return
+	}
+	ids := map[string]string{}
+	for rows.Next() {
+		var id, key string
+		if err := rows.Scan(&id, &key); err == nil {
+			ids[id] = key
+		}
+	}
+	rows.Close()
+
+	for id, key := range ids {
+		if err := h.blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("Warning: failed to delete upload chunk %s: %v", key, err)
+			continue
+		}
+		h.db.Exec("DELETE FROM upload_chunks WHERE id = $1", id)
+	}
+}
+
+func (h *UploadHandler) remove(uploadID string) {
+	h.db.Exec("DELETE FROM upload_sessions WHERE id = $1", uploadID)
+	h.deleteChunks("SELECT id, blob_key FROM upload_chunks WHERE upload_id = $1", uploadID)
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64(value)" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		meta[key] = strings.TrimSpace(string(value))
+	}
+	return meta
+}
+
+// parseUploadChecksum decodes an Upload-Checksum header. The hash is nil
+// for an unsupported algorithm or a malformed digest.
+func parseUploadChecksum(header string) ([]byte, hash.Hash) {
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil
+	}
+
+	var sum hash.Hash
+	switch algorithm {
+	case "sha1":
+		sum = sha1.New()
+	case "sha256":
+		sum = sha256.New()
+	case "md5":
+		sum = md5.New()
+	default:
+		return nil, nil
+	}
+	if len(digest) != sum.Size() {
+		return nil, nil
+	}
+	return digest, sum
+}
@@ -4,18 +4,23 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/gili/backend/audit"
 	"github.com/gili/backend/config"
+	"github.com/gili/backend/middleware"
 	"github.com/gili/backend/models"
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UserHandler struct {
-	db  *sql.DB
-	cfg *config.Config
+	db       *sql.DB
+	cfg      *config.Config
+	denylist *middleware.TokenDenylist
+	audit    *audit.Recorder
 }
 
-func NewUserHandler(db *sql.DB, cfg *config.Config) *UserHandler {
-	return &UserHandler{db: db, cfg: cfg}
+func NewUserHandler(db *sql.DB, cfg *config.Config, denylist *middleware.TokenDenylist, rec *audit.Recorder) *UserHandler {
+	return &UserHandler{db: db, cfg: cfg, denylist: denylist, audit: rec}
 }
 
 func (h *UserHandler) GetProfile(c *fiber.Ctx) error {
@@ -23,11 +28,13 @@ func (h *UserHandler) GetProfile(c *fiber.Ctx) error {
 
 	var user models.User
 	err := h.db.QueryRow(`
-		SELECT id, name, email, age, level, avatar, created_at, updated_at
+		SELECT id, name, COALESCE(email, ''), username, age, level, avatar, role, consent_status,
+		       email_verified_at, deletion_scheduled_at, created_at, updated_at
 		FROM users WHERE id = $1
 	`, userID).Scan(
-		&user.ID, &user.Name, &user.Email, &user.Age,
-		&user.Level, &user.Avatar, &user.CreatedAt, &user.UpdatedAt,
+		&user.ID, &user.Name, &user.Email, &user.Username, &user.Age,
+		&user.Level, &user.Avatar, &user.Role, &user.ConsentStatus,
+		&user.EmailVerifiedAt, &user.DeletionScheduledAt, &user.CreatedAt, &user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -58,26 +65,39 @@ func (h *UserHandler) UpdateProfile(c *fiber.Ctx) error {
 	query := "UPDATE users SET updated_at = CURRENT_TIMESTAMP"
 	args := []interface{}{}
 	argCount := 0
+	changed := []string{}
 
 	if req.Name != "" {
 		argCount++
 		query += fmt.Sprintf(", name = $%d", argCount)
 		args = append(args, req.Name)
+		changed = append(changed, "name")
 	}
 	if req.Age != nil {
 		argCount++
 		query += fmt.Sprintf(", age = $%d", argCount)
 		args = append(args, *req.Age)
+
+		// Lowering the age below the threshold requires consent; raising it
+		// never lifts a pending consent. A student who had not stated an age
+		// yet gets the status their age would have given at registration.
+		argCount++
+		query += fmt.Sprintf(", consent_status = CASE WHEN $%d AND consent_status = 'not_required' THEN 'pending' "+
+			"WHEN NOT $%d AND age IS NULL AND consent_status = 'pending' THEN 'not_required' ELSE consent_status END", argCount, argCount)
+		args = append(args, *req.Age < h.cfg.ConsentAgeThreshold)
+		changed = append(changed, "age")
 	}
 	if req.Level != "" {
 		argCount++
 		query += fmt.Sprintf(", level = $%d", argCount)
 		args = append(args, req.Level)
+		changed = append(changed, "level")
 	}
 	if req.Avatar != "" {
 		argCount++
 		query += fmt.Sprintf(", avatar = $%d", argCount)
 		args = append(args, req.Avatar)
+		changed = append(changed, "avatar")
 	}
 
 	argCount++
@@ -91,6 +111,84 @@ func (h *UserHandler) UpdateProfile(c *fiber.Ctx) error {
 		})
 	}
 
+	if len(changed) > 0 {
+		h.audit.Request(c, audit.ProfileUpdated, audit.TargetUser, userID, map[string]interface{}{
+			"fields": changed,
+		})
+	}
+
 	// Return updated user
 	return h.GetProfile(c)
 }
+
+func (h *UserHandler) ChangePassword(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	var req models.ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Current and new password are required",
+		})
+	}
+
+	if len(req.NewPassword) < 6 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password must be at least 6 characters",
+		})
+	}
+
+	var passwordHash string
+	err := h.db.QueryRow("SELECT COALESCE(password_hash, '') FROM users WHERE id = $1", userID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Current password is incorrect",
+		})
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+
+	// Sign out every other device; the current one stays logged in
+	if _, err := revokeSessions(h.db, h.denylist, userID, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	h.audit.Request(c, audit.PasswordChanged, audit.TargetUser, userID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Password changed successfully",
+	})
+}
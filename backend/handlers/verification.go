@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/mailer"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// verificationResendInterval is the minimum time between verification emails.
+const verificationResendInterval = time.Minute
+
+func (h *AuthHandler) VerifyEmail(c *fiber.Ctx) error {
+	var req models.VerifyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is required",
+		})
+	}
+
+	var userID string
+	err := h.db.QueryRow(`
+		UPDATE email_verifications SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id
+	`, middleware.HashToken(req.Token)).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired verification token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP),
+		                 updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify email",
+		})
+	}
+
+	h.audit.RequestBy(c, userID, "", "", audit.EmailVerified, audit.TargetUser, userID, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "Email verified successfully",
+	})
+}
+
+func (h *AuthHandler) ResendVerification(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var email, name string
+	var verifiedAt sql.NullTime
+	err := h.db.QueryRow(`
+		SELECT COALESCE(email, ''), name, email_verified_at FROM users WHERE id = $1
+	`, userID).Scan(&email, &name, &verifiedAt)
+
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Account has no email address",
+		})
+	}
+
+	if verifiedAt.Valid {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Email is already verified",
+		})
+	}
+
+	var recent bool
+	h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM email_verifications WHERE user_id = $1 AND created_at > $2)
+	`, userID, time.Now().Add(-verificationResendInterval)).Scan(&recent)
+	if recent {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Please wait before requesting another verification email",
+		})
+	}
+
+	if err := h.sendVerificationEmail(userID, email, name); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send verification email",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Verification email sent",
+	})
+}
+
+// sendVerificationEmail replaces any pending verification token for the user
+// and emails a link containing the new one.
+func (h *AuthHandler) sendVerificationEmail(userID, email, name string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	h.db.Exec(`
+		UPDATE email_verifications SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+
+	_, err = h.db.Exec(`
+		INSERT INTO email_verifications (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, userID, middleware.HashToken(token), time.Now().Add(h.cfg.EmailVerificationExpiry))
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", h.cfg.AppBaseURL, url.QueryEscape(token))
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Konfirmasi email Gili",
+		Body: fmt.Sprintf(
+			"Halo %s,\n\nTerima kasih sudah bergabung dengan Gili! Buka tautan berikut untuk mengonfirmasi email kamu:\n\n%s\n\nTautan ini berlaku %d jam.",
+			name, link, int(h.cfg.EmailVerificationExpiry.Hours()),
+		),
+	}
+	go func() {
+		if err := h.mailer.Send(msg); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// generateToken returns a random 256-bit hex token.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
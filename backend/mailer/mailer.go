@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"fmt"
+
+	"github.com/gili/backend/config"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset codes.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the Mailer selected by cfg.MailDriver.
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.MailDriver {
+	case "smtp":
+		return NewSMTPMailer(cfg), nil
+	case "outbox":
+		return NewOutboxMailer(cfg.MailOutboxDir, cfg.MailFrom)
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.MailDriver)
+	}
+}
+
+func formatMessage(from string, msg Message) []byte {
+	return []byte(fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, msg.To, msg.Subject, msg.Body,
+	))
+}
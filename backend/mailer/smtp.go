@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+
+	"github.com/gili/backend/config"
+)
+
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(cfg *config.Config) *SMTPMailer {
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%s", cfg.SMTPHost, cfg.SMTPPort),
+		auth: auth,
+		from: cfg.MailFrom,
+	}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
@@ -4,10 +4,17 @@ import (
 	"log"
 	"os"
 
+	"github.com/gili/backend/audit"
 	"github.com/gili/backend/config"
 	"github.com/gili/backend/database"
+	"github.com/gili/backend/events"
+	"github.com/gili/backend/mailer"
 	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/privacy"
+	"github.com/gili/backend/retry"
 	"github.com/gili/backend/routes"
+	"github.com/gili/backend/storage"
+	"github.com/gili/backend/transcribe"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -23,6 +30,9 @@ func main() {
 
 	// Initialize config
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize database
 	db, err := database.Connect(cfg)
@@ -32,7 +42,7 @@ func main() {
 	defer db.Close()
 
 	// Run migrations
-	if err := database.Migrate(db); err != nil {
+	if err := database.Migrate(db, cfg); err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
@@ -48,11 +58,48 @@ func main() {
 		defer rmq.Close()
 	}
 
+	// Initialize JWT signing keys
+	keys, err := middleware.NewKeyManager(db, cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize JWT keys: %v", err)
+	}
+	keys.Start()
+
+	// Initialize mailer
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Initialize blob storage for recordings
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize blob storage: %v", err)
+	}
+
+	// Start speech-to-text worker for audio stories
+	transcriber, err := transcribe.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize transcriber: %v", err)
+	}
+	transcribe.NewWorker(db, cfg, rmq, blobs, transcriber).Start()
+
+	// Start retries of failed transcriptions and evaluations
+	retry.NewWorker(db, rmq).Start()
+
+	// Start personal data export and account deletion worker
+	denylist := middleware.NewTokenDenylist(rdb, db, cfg.JWTRefreshExpiry)
+	privacy.NewWorker(db, cfg, rmq, denylist, blobs, audit.NewRecorder(db)).Start()
+
+	// Start story event stream (LISTEN/NOTIFY)
+	hub := events.NewHub(cfg)
+	hub.Start()
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName:      "Gili API",
 		ErrorHandler: middleware.ErrorHandler,
-		BodyLimit:    10 * 1024 * 1024, // 10MB limit for audio uploads
+		BodyLimit:    int(cfg.AudioMaxSize) + 1024*1024, // audio uploads plus form fields
 	})
 
 	// Global middleware
@@ -60,15 +107,17 @@ func main() {
 	app.Use(logger.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, " +
+			"Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum",
+		AllowMethods:  "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders: "Location, Tus-Resumable, Tus-Version, Upload-Length, Upload-Offset, Upload-Expires, Upload-Story-Id",
 	}))
 
 	// Rate limiting
-	app.Use(middleware.RateLimiter(rdb))
+	app.Use(middleware.RateLimiter(rdb, "/api/v1/integrations"))
 
 	// Setup routes
-	routes.Setup(app, db, rdb, rmq, cfg)
+	routes.Setup(app, db, rdb, rmq, mail, keys, blobs, hub, cfg)
 
 	// Health check
 	app.Get("/health", func(c *fiber.Ctx) error {
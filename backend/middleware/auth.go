@@ -1,22 +1,45 @@
 package middleware
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"strings"
 	"time"
 
+	"github.com/gili/backend/audit"
 	"github.com/gili/backend/config"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenRevoked  = errors.New("refresh token revoked")
+	ErrUserBanned           = errors.New("user is banned")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected")
+)
+
+// Token types, carried in the typ claim so that a refresh token is never
+// accepted as an access token or the other way round.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
 )
 
 type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	FamilyID  string `json:"fid,omitempty"`
+	TokenType string `json:"typ"`
 	jwt.RegisteredClaims
 }
 
-func AuthMiddleware(cfg *config.Config) fiber.Handler {
+func AuthMiddleware(keys *KeyManager, denylist *TokenDenylist, rec *audit.Recorder) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
@@ -32,9 +55,7 @@ func AuthMiddleware(cfg *config.Config) fiber.Handler {
 			})
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.Keyfunc)
 
 		if err != nil || !token.Valid {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -43,49 +64,68 @@ func AuthMiddleware(cfg *config.Config) fiber.Handler {
 		}
 
 		claims, ok := token.Claims.(*Claims)
-		if !ok {
+		if !ok || claims.TokenType != TokenTypeAccess {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid token claims",
 			})
 		}
 
+		if denylist != nil && denylist.IsDenied(claims) {
+			rec.RequestBy(c, claims.UserID, claims.Role, claims.FamilyID, audit.RevokedTokenUsed, audit.TargetSession, claims.FamilyID, nil)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Token has been revoked",
+			})
+		}
+
 		// Set user info in context
 		c.Locals("userID", claims.UserID)
 		c.Locals("email", claims.Email)
+		c.Locals("role", claims.Role)
+		c.Locals("sessionID", claims.FamilyID)
+		c.Locals("claims", claims)
 
 		return c.Next()
 	}
 }
 
-func GenerateTokens(userID, email string, cfg *config.Config) (accessToken, refreshToken string, err error) {
+// GenerateTokens issues an access/refresh token pair. Both tokens carry the
+// refresh token family so that a rotated refresh token stays linked to the
+// login it descends from.
+func GenerateTokens(userID, email, role, familyID string, cfg *config.Config, keys *KeyManager) (accessToken, refreshToken string, err error) {
 	// Access token
 	accessClaims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		FamilyID:  familyID,
+		TokenType: TokenTypeAccess,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(cfg.JWTExpiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	accessTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessToken, err = accessTokenObj.SignedString([]byte(cfg.JWTSecret))
+	accessToken, err = keys.Sign(accessClaims)
 	if err != nil {
 		return "", "", err
 	}
 
 	// Refresh token
 	refreshClaims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		FamilyID:  familyID,
+		TokenType: TokenTypeRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(cfg.JWTRefreshExpiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	refreshTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshToken, err = refreshTokenObj.SignedString([]byte(cfg.JWTSecret))
+	refreshToken, err = keys.Sign(refreshClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -93,19 +133,83 @@ func GenerateTokens(userID, email string, cfg *config.Config) (accessToken, refr
 	return accessToken, refreshToken, nil
 }
 
-func ValidateRefreshToken(tokenString string, cfg *config.Config, db *sql.DB) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.JWTSecret), nil
-	})
+// ValidateRefreshToken checks the refresh token signature, its type and its
+// stored state. Tokens revoked by logout are rejected with ErrRefreshTokenRevoked.
+// Presenting a token that was already rotated is treated as theft: the whole
+// family is revoked and ErrRefreshTokenReused is returned together with the
+// claims so the caller can log which family was affected.
+// The role is reloaded from the database so role changes apply on refresh.
+func ValidateRefreshToken(tokenString string, keys *KeyManager, db *sql.DB) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.Keyfunc)
 
 	if err != nil || !token.Valid {
 		return nil, err
 	}
 
 	claims, ok := token.Claims.(*Claims)
-	if !ok {
+	if !ok || claims.TokenType != TokenTypeRefresh {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	var userID, familyID, role string
+	var expiresAt time.Time
+	var revokedAt, bannedAt sql.NullTime
+	var replacedBy sql.NullString
+	err = db.QueryRow(`
+		SELECT rt.user_id, rt.family_id, rt.expires_at, rt.revoked_at, rt.replaced_by, u.role, u.banned_at
+		FROM refresh_tokens rt
+		JOIN users u ON u.id = rt.user_id
+		WHERE rt.token_hash = $1
+	`, HashToken(tokenString)).Scan(&userID, &familyID, &expiresAt, &revokedAt, &replacedBy, &role, &bannedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if userID != claims.UserID {
 		return nil, jwt.ErrTokenInvalidClaims
 	}
 
+	claims.FamilyID = familyID
+
+	if revokedAt.Valid && !replacedBy.Valid {
+		return nil, ErrRefreshTokenRevoked
+	}
+
+	if revokedAt.Valid {
+		if err := RevokeTokenFamily(db, familyID); err != nil {
+			return nil, err
+		}
+		return claims, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if bannedAt.Valid {
+		return nil, ErrUserBanned
+	}
+
+	claims.Role = role
+
 	return claims, nil
 }
+
+// RevokeTokenFamily revokes every refresh token descended from the same login.
+func RevokeTokenFamily(db *sql.DB, familyID string) error {
+	_, err := db.Exec(`
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`, familyID)
+	return err
+}
+
+// HashToken returns the hex SHA-256 digest under which a token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
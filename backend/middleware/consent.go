@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	ConsentNotRequired = "not_required"
+	ConsentPending     = "pending"
+	ConsentGranted     = "granted"
+)
+
+// RequireConsent blocks features such as audio upload and sharing for young
+// users until a guardian has consented. It must run after AuthMiddleware.
+func RequireConsent(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pending, err := ConsentIsPending(db, c.Locals("userID").(string))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+
+		if pending {
+			return ConsentRequired(c)
+		}
+
+		return c.Next()
+	}
+}
+
+// ConsentIsPending reports whether userID still waits for guardian consent.
+func ConsentIsPending(db *sql.DB, userID string) (bool, error) {
+	var status string
+	err := db.QueryRow("SELECT consent_status FROM users WHERE id = $1", userID).Scan(&status)
+	if err != nil {
+		return false, err
+	}
+	return status == ConsentPending, nil
+}
+
+// ConsentRequired writes the response for a feature blocked by missing consent.
+func ConsentRequired(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error":            "A parent or guardian needs to give consent before you can use this feature",
+		"consent_required": true,
+	})
+}
+
+// ConsentStatusForAge returns the initial consent status for a user of the
+// given age and role. Students who did not state an age are treated as young
+// enough to need consent.
+func ConsentStatusForAge(age *int, role string, threshold int) string {
+	if role == RoleStudent && (age == nil || *age < threshold) {
+		return ConsentPending
+	}
+	return ConsentNotRequired
+}
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenDenylist revokes access tokens before they expire. Entries are keyed by
+// JWT ID, by session, or by user (every token issued before a cut-off time).
+// Entries are written to Redis so that all API instances see them, and kept
+// in memory so that this instance still honours them if Redis goes down.
+// When Redis cannot be read, session revocation is checked in Postgres.
+type TokenDenylist struct {
+	rdb    *redis.Client
+	db     *sql.DB
+	expiry time.Duration
+
+	mu    sync.Mutex
+	local map[string]localEntry
+}
+
+// maxLocalEntries is the size at which expired in-memory entries are swept.
+const maxLocalEntries = 10000
+
+type localEntry struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// NewTokenDenylist keeps session and user entries for expiry, which should be
+// the lifetime of the longest token issued (the refresh token).
+func NewTokenDenylist(rdb *redis.Client, db *sql.DB, expiry time.Duration) *TokenDenylist {
+	return &TokenDenylist{
+		rdb:    rdb,
+		db:     db,
+		expiry: expiry,
+		local:  make(map[string]localEntry),
+	}
+}
+
+func jtiKey(jti string) string           { return fmt.Sprintf("denylist:jti:%s", jti) }
+func sessionKey(sessionID string) string { return fmt.Sprintf("denylist:session:%s", sessionID) }
+func userKey(userID string) string       { return fmt.Sprintf("denylist:user:%s", userID) }
+
+// DenyToken revokes a single access token until it would have expired anyway.
+func (d *TokenDenylist) DenyToken(jti string, expiresAt time.Time) {
+	if jti == "" {
+		return
+	}
+	d.set(jtiKey(jti), 1, time.Until(expiresAt))
+}
+
+// DenySession revokes every access token issued for a session.
+func (d *TokenDenylist) DenySession(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	d.set(sessionKey(sessionID), 1, d.expiry)
+}
+
+// DenyUser revokes every access token issued to a user up to now, e.g. after
+// a password change or a ban. Tokens issued afterwards are accepted.
+func (d *TokenDenylist) DenyUser(userID string) {
+	d.set(userKey(userID), time.Now().Unix(), d.expiry)
+}
+
+// IsDenied reports whether the access token described by claims was revoked.
+func (d *TokenDenylist) IsDenied(claims *Claims) bool {
+	keys := []string{jtiKey(claims.ID), sessionKey(claims.FamilyID), userKey(claims.UserID)}
+
+	values, err := d.get(keys)
+	if err != nil {
+		// Redis unavailable: fall back to this instance's entries and the
+		// session state in Postgres
+		values = d.getLocal(keys)
+		if d.sessionRevoked(claims.FamilyID) {
+			return true
+		}
+	}
+
+	if claims.ID != "" && values[0] != 0 {
+		return true
+	}
+	if claims.FamilyID != "" && values[1] != 0 {
+		return true
+	}
+	if values[2] != 0 && (claims.IssuedAt == nil || claims.IssuedAt.Unix() < values[2]) {
+		return true
+	}
+	return false
+}
+
+func (d *TokenDenylist) set(key string, value int64, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	now := time.Now()
+	if len(d.local) >= maxLocalEntries {
+		for k, entry := range d.local {
+			if now.After(entry.expiresAt) {
+				delete(d.local, k)
+			}
+		}
+	}
+	d.local[key] = localEntry{value: value, expiresAt: now.Add(ttl)}
+	d.mu.Unlock()
+
+	if d.rdb == nil {
+		return
+	}
+	if err := d.rdb.Set(context.Background(), key, value, ttl).Err(); err != nil {
+		log.Printf("Warning: failed to write token denylist entry %s: %v", key, err)
+	}
+}
+
+// get reads keys from Redis, merged with local entries so that revocations
+// made while Redis was down are not lost once it comes back.
+func (d *TokenDenylist) get(keys []string) ([]int64, error) {
+	if d.rdb == nil {
+		return nil, redis.ErrClosed
+	}
+
+	results, err := d.rdb.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values := d.getLocal(keys)
+	for i, result := range results {
+		s, ok := result.(string)
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && v > values[i] {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+func (d *TokenDenylist) getLocal(keys []string) []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	values := make([]int64, len(keys))
+	for i, key := range keys {
+		entry, ok := d.local[key]
+		if !ok {
+			continue
+		}
+		if now.After(entry.expiresAt) {
+			delete(d.local, key)
+			continue
+		}
+		values[i] = entry.value
+	}
+	return values
+}
+
+func (d *TokenDenylist) sessionRevoked(sessionID string) bool {
+	if d.db == nil || sessionID == "" {
+		return false
+	}
+
+	var revoked bool
+	err := d.db.QueryRow(`
+		SELECT revoked_at IS NOT NULL FROM sessions WHERE id = $1
+	`, sessionID).Scan(&revoked)
+	return err == nil && revoked
+}
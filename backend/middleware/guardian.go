@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// RequireGuardian lets a guardian act on the child named by the :id route
+// parameter. The child's ID is stored as "subjectID" so that read handlers
+// serve the child's data instead of the caller's. It must run after
+// AuthMiddleware.
+func RequireGuardian(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		guardianID := c.Locals("userID").(string)
+		childID := c.Params("id")
+
+		if !IsGuardianOf(db, guardianID, childID) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Child not found",
+			})
+		}
+
+		c.Locals("subjectID", childID)
+		return c.Next()
+	}
+}
+
+// IsGuardianOf reports whether guardianID has an active link to childID.
+func IsGuardianOf(db *sql.DB, guardianID, childID string) bool {
+	if _, err := uuid.Parse(childID); err != nil {
+		return false
+	}
+
+	var linked bool
+	db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM guardianships
+			WHERE guardian_id = $1 AND child_id = $2 AND status = 'active'
+		)
+	`, guardianID, childID).Scan(&linked)
+	return linked
+}
+
+// SubjectUserID returns the user whose data a request reads: the child set by
+// RequireGuardian, or otherwise the caller.
+func SubjectUserID(c *fiber.Ctx) string {
+	if subjectID, ok := c.Locals("subjectID").(string); ok && subjectID != "" {
+		return subjectID
+	}
+	return c.Locals("userID").(string)
+}
@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyRotationLockID is the Postgres advisory lock that serialises key
+// rotation across API instances.
+const keyRotationLockID = 7263001
+
+// keyCheckInterval is how often instances reload keys and check whether a
+// rotation is due.
+const keyCheckInterval = 10 * time.Minute
+
+// keyPrepublishPeriod is how long a new key is published in the JWKS before
+// it starts signing, so that verifiers caching the JWKS already know it.
+const keyPrepublishPeriod = time.Hour
+
+// KeyManager holds the RS256 keys used to sign and verify JWTs. Keys live in
+// the jwt_signing_keys table (private keys encrypted with JWT_SECRET) so that
+// every API instance signs with the same key. Each key is identified by the
+// "kid" header. Retired keys keep verifying until every token they signed has
+// expired.
+type KeyManager struct {
+	db  *sql.DB
+	cfg *config.Config
+	aes cipher.AEAD
+
+	mu      sync.RWMutex
+	keys    map[string]*signingKey
+	current *signingKey
+}
+
+type signingKey struct {
+	kid         string
+	private     *rsa.PrivateKey
+	activatesAt time.Time
+	expiresAt   *time.Time
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKeyManager loads the signing keys, creating the first one if none exist.
+func NewKeyManager(db *sql.DB, cfg *config.Config) (*KeyManager, error) {
+	secret := sha256.Sum256([]byte(cfg.JWTSecret))
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &KeyManager{db: db, cfg: cfg, aes: aead}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	if m.signer() == nil {
+		if err := m.rotate(0); err != nil {
+			return nil, err
+		}
+	}
+
+	// Another instance may have been creating the first key at the same time
+	if m.signer() == nil {
+		time.Sleep(time.Second)
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+		if m.signer() == nil {
+			return nil, errors.New("no JWT signing key available")
+		}
+	}
+
+	return m, nil
+}
+
+// Start reloads keys periodically and rotates the signing key once it is
+// older than cfg.JWTKeyRotationInterval. It returns immediately.
+func (m *KeyManager) Start() {
+	go func() {
+		ticker := time.NewTicker(keyCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := m.load(); err != nil {
+				log.Printf("Warning: failed to reload JWT keys: %v", err)
+				continue
+			}
+			if m.rotationDue() {
+				if err := m.rotate(keyPrepublishPeriod); err != nil {
+					log.Printf("Warning: failed to rotate JWT key: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Sign signs claims with the current key.
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key := m.signer()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc resolves the verification key for a token from its "kid" header.
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 && m.cfg.JWTAcceptLegacyHS256 {
+		return []byte(m.cfg.JWTSecret), nil
+	}
+
+	if token.Method != jwt.SigningMethodRS256 {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	m.mu.RLock()
+	key, ok := m.keys[kid]
+	m.mu.RUnlock()
+
+	if !ok || (key.expiresAt != nil && time.Now().After(*key.expiresAt)) {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return &key.private.PublicKey, nil
+}
+
+// JWKS returns every public key that may still verify a token, including a
+// key that is published but not yet signing.
+func (m *KeyManager) JWKS() JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range m.keys {
+		if key.expiresAt != nil && now.After(*key.expiresAt) {
+			continue
+		}
+		pub := key.private.PublicKey
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: key.kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
+
+// signer returns the newest key that is already active.
+func (m *KeyManager) signer() *signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current
+}
+
+// rotationDue reports whether the signing key is old enough to be replaced
+// and no replacement has been published yet.
+func (m *KeyManager) rotationDue() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.current == nil {
+		return true
+	}
+	for _, key := range m.keys {
+		if key.activatesAt.After(m.current.activatesAt) {
+			return false
+		}
+	}
+	return time.Since(m.current.activatesAt) >= m.cfg.JWTKeyRotationInterval
+}
+
+func (m *KeyManager) load() error {
+	rows, err := m.db.Query(`
+		SELECT kid, private_key, activates_at, expires_at
+		FROM jwt_signing_keys
+		WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]*signingKey)
+	var current *signingKey
+	now := time.Now()
+	for rows.Next() {
+		var key signingKey
+		var encrypted []byte
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&key.kid, &encrypted, &key.activatesAt, &expiresAt); err != nil {
+			return err
+		}
+		if expiresAt.Valid {
+			key.expiresAt = &expiresAt.Time
+		}
+
+		key.private, err = m.decrypt(encrypted)
+		if err != nil {
+			log.Printf("Warning: cannot decrypt JWT key %s (was JWT_SECRET changed?): %v", key.kid, err)
+			continue
+		}
+
+		keys[key.kid] = &key
+		if !key.activatesAt.After(now) && (current == nil || key.activatesAt.After(current.activatesAt)) {
+			current = &key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.current = current
+	m.mu.Unlock()
+	return nil
+}
+
+// rotate creates a new key that starts signing after delay. Older keys stop
+// verifying once every token they could have signed has expired.
+func (m *KeyManager) rotate(delay time.Duration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Another instance is rotating right now; pick up its key on next load
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", keyRotationLockID).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	encrypted, err := m.encrypt(private)
+	if err != nil {
+		return err
+	}
+
+	kid, err := keyID(&private.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	activatesAt := time.Now().Add(delay)
+	retireAt := activatesAt.Add(m.cfg.JWTRefreshExpiry)
+
+	_, err = tx.Exec(`
+		UPDATE jwt_signing_keys SET expires_at = $1 WHERE expires_at IS NULL
+	`, retireAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO jwt_signing_keys (kid, algorithm, private_key, activates_at)
+		VALUES ($1, 'RS256', $2, $3)
+	`, kid, encrypted, activatesAt)
+	if err != nil {
+		return err
+	}
+
+	tx.Exec("DELETE FROM jwt_signing_keys WHERE expires_at < CURRENT_TIMESTAMP")
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("🔑 New JWT signing key %s, active from %s", kid, activatesAt.Format(time.RFC3339))
+	return m.load()
+}
+
+func (m *KeyManager) encrypt(key *rsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, m.aes.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aes.Seal(nonce, nonce, der, nil), nil
+}
+
+func (m *KeyManager) decrypt(data []byte) (*rsa.PrivateKey, error) {
+	size := m.aes.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	der, err := m.aes.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// keyID derives a stable kid from the public key.
+func keyID(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
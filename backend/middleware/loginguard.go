@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// LoginGuard slows down password and PIN guessing. Failed logins are counted per
+// account and per IP in Redis. Each failure on an account beyond the free
+// attempts doubles the wait before the next try, and too many failures lock
+// the account until the lock expires. The per-IP limit is deliberately much
+// higher than the per-account one because whole classrooms share one IP.
+// Every attempt is counted as a failure by Claim before the credentials are
+// compared, so parallel guesses cannot slip past the limits; RecordSuccess
+// takes it back. If Redis is unavailable, logins are allowed (like
+// RateLimiter).
+type LoginGuard struct {
+	rdb    *redis.Client
+	prefix string
+	limits LoginLimits
+}
+
+// LoginLimits configures a LoginGuard.
+type LoginLimits struct {
+	FreeAttempts       int
+	MaxDelay           time.Duration
+	MaxAccountFailures int
+	MaxIPFailures      int
+	FailureWindow      time.Duration
+	LockDuration       time.Duration
+}
+
+// NewLoginGuard returns the guard for email + password logins.
+func NewLoginGuard(rdb *redis.Client, cfg *config.Config) *LoginGuard {
+	return &LoginGuard{rdb: rdb, prefix: "login", limits: LoginLimits{
+		FreeAttempts:       cfg.LoginFreeAttempts,
+		MaxDelay:           cfg.LoginMaxDelay,
+		MaxAccountFailures: cfg.LoginMaxAccountFailures,
+		MaxIPFailures:      cfg.LoginMaxIPFailures,
+		FailureWindow:      cfg.LoginFailureWindow,
+		LockDuration:       cfg.LoginLockDuration,
+	}}
+}
+
+// NewPINGuard returns the guard for child PIN logins. A short PIN has few
+// combinations, so it locks much sooner than a password, and one IP gets far
+// fewer failures across all accounts than with passwords.
+func NewPINGuard(rdb *redis.Client, cfg *config.Config) *LoginGuard {
+	return &LoginGuard{rdb: rdb, prefix: "pin", limits: LoginLimits{
+		FreeAttempts:       1,
+		MaxDelay:           cfg.LoginMaxDelay,
+		MaxAccountFailures: cfg.PINMaxFailures,
+		MaxIPFailures:      cfg.PINMaxIPFailures,
+		FailureWindow:      cfg.PINLockDuration,
+		LockDuration:       cfg.PINLockDuration,
+	}}
+}
+
+func (g *LoginGuard) failKey(account string) string {
+	return fmt.Sprintf("%s:fail:account:%s", g.prefix, account)
+}
+
+func (g *LoginGuard) delayKey(account string) string {
+	return fmt.Sprintf("%s:delay:account:%s", g.prefix, account)
+}
+
+func (g *LoginGuard) lockKey(account string) string {
+	return fmt.Sprintf("%s:lock:account:%s", g.prefix, account)
+}
+
+func (g *LoginGuard) ipKey(ip string) string {
+	return fmt.Sprintf("%s:fail:ip:%s", g.prefix, ip)
+}
+
+// NormalizeAccount returns the key under which failures for an account
+// identifier (email or username) are counted.
+func NormalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+// claimScript refuses an attempt while the account is locked or waiting, or
+// the IP is over its limit, and otherwise counts it as a failure and sets the
+// lock or wait that applies to the next attempt. It returns {1, ms} when
+// refused by a lock, {0, ms} when refused by a wait, and {-1, 0} when the
+// attempt may proceed.
+//
+// KEYS: fail, delay, lock, ip
+// ARGV: free attempts, max account failures, max IP failures, failure window
+// ms, lock ms, max delay ms
+var claimScript = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[3])
+if ttl > 0 then return {1, ttl} end
+ttl = redis.call('PTTL', KEYS[2])
+if ttl > 0 then return {0, ttl} end
+if tonumber(redis.call('GET', KEYS[4]) or '0') >= tonumber(ARGV[3]) then
+	ttl = redis.call('PTTL', KEYS[4])
+	if ttl > 0 then return {0, ttl} end
+end
+
+local failures = redis.call('INCR', KEYS[1])
+if failures == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[4]) end
+if redis.call('INCR', KEYS[4]) == 1 then redis.call('PEXPIRE', KEYS[4], ARGV[4]) end
+
+if failures >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[3], 1, 'PX', ARGV[5])
+	redis.call('DEL', KEYS[1], KEYS[2])
+elseif failures > tonumber(ARGV[1]) then
+	local delay = math.min(1000 * 2 ^ (failures - tonumber(ARGV[1]) - 1), tonumber(ARGV[6]))
+	redis.call('SET', KEYS[2], 1, 'PX', math.floor(delay))
+end
+return {-1, 0}
+`)
+
+// releaseScript takes back an attempt counted by claimScript.
+//
+// KEYS: fail, delay, lock, ip
+// ARGV: 1 to clear the account's failures, delay and lock as well
+var releaseScript = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[4]) or '0') > 0 then redis.call('DECR', KEYS[4]) end
+if ARGV[1] == '1' then
+	redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+elseif tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+// Claim counts an attempt to log in to account from ip as a failure, before
+// the credentials are checked. A non-zero wait means the attempt is refused:
+// the caller must wait that long, and locked says whether the account is
+// locked. Otherwise the caller checks the credentials and then calls
+// RecordFailure or RecordSuccess.
+func (g *LoginGuard) Claim(account, ip string) (wait time.Duration, locked bool) {
+	if g.rdb == nil {
+		return 0, false
+	}
+
+	account = NormalizeAccount(account)
+	res, err := claimScript.Run(context.Background(), g.rdb,
+		[]string{g.failKey(account), g.delayKey(account), g.lockKey(account), g.ipKey(ip)},
+		g.limits.FreeAttempts, g.limits.MaxAccountFailures, g.limits.MaxIPFailures,
+		g.limits.FailureWindow.Milliseconds(), g.limits.LockDuration.Milliseconds(),
+		g.limits.MaxDelay.Milliseconds(),
+	).Int64Slice()
+	if err != nil || len(res) != 2 || res[0] < 0 {
+		return 0, false
+	}
+	return time.Duration(res[1]) * time.Millisecond, res[0] == 1
+}
+
+// RecordFailure reports the wait imposed on the account after a failed
+// attempt, which Claim has already counted, and whether it is now locked.
+func (g *LoginGuard) RecordFailure(account, ip string) (wait time.Duration, locked bool) {
+	if g.rdb == nil {
+		return 0, false
+	}
+
+	ctx := context.Background()
+	account = NormalizeAccount(account)
+
+	if ttl, err := g.rdb.PTTL(ctx, g.lockKey(account)).Result(); err == nil && ttl > 0 {
+		return ttl, true
+	}
+	if ttl, err := g.rdb.PTTL(ctx, g.delayKey(account)).Result(); err == nil && ttl > 0 {
+		return ttl, false
+	}
+	return 0, false
+}
+
+// RecordSuccess clears the failure history of an account, including a lock
+// set by the attempt that succeeded, and takes back the attempt on the IP.
+// Other IP failures are left alone so one correct password cannot reset an
+// IP-wide attack.
+func (g *LoginGuard) RecordSuccess(account, ip string) {
+	g.release(account, ip, true)
+}
+
+// Release takes back an attempt whose credentials were correct but which
+// needs another step, such as a second factor, before it succeeds.
+func (g *LoginGuard) Release(account, ip string) {
+	g.release(account, ip, false)
+}
+
+func (g *LoginGuard) release(account, ip string, success bool) {
+	if g.rdb == nil {
+		return
+	}
+	account = NormalizeAccount(account)
+	clear := "0"
+	if success {
+		clear = "1"
+	}
+	releaseScript.Run(context.Background(), g.rdb,
+		[]string{g.failKey(account), g.delayKey(account), g.lockKey(account), g.ipKey(ip)}, clear)
+}
+
+// Unlock lifts a lock and clears the failure history of an account.
+func (g *LoginGuard) Unlock(account string) error {
+	if g.rdb == nil {
+		return nil
+	}
+	account = NormalizeAccount(account)
+	return g.rdb.Del(context.Background(),
+		g.failKey(account), g.delayKey(account), g.lockKey(account)).Err()
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gili/backend/config"
+	"github.com/redis/go-redis/v9"
+)
+
+var testLimits = LoginLimits{
+	FreeAttempts:       3,
+	MaxDelay:           4 * time.Second,
+	MaxAccountFailures: 7,
+	MaxIPFailures:      100,
+	FailureWindow:      15 * time.Minute,
+	LockDuration:       30 * time.Minute,
+}
+
+func newTestGuard(t *testing.T, limits LoginLimits) (*LoginGuard, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return &LoginGuard{rdb: rdb, prefix: "login", limits: limits}, mr
+}
+
+// TestLoginGuardThresholds makes one failed attempt after another, waiting
+// out each delay, and checks the delay or lock after every failure.
+func TestLoginGuardThresholds(t *testing.T) {
+	g, mr := newTestGuard(t, testLimits)
+
+	tests := []struct {
+		failure int
+		wait    time.Duration
+		locked  bool
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, 0, false},
+		{4, time.Second, false},
+		{5, 2 * time.Second, false},
+		{6, 4 * time.Second, false},
+		{7, 30 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		if wait, _ := g.Claim("Ana@Example.com ", "10.0.0.1"); wait != 0 {
+			t.Fatalf("failure %d: Claim refused with wait %v", tt.failure, wait)
+		}
+		wait, locked := g.RecordFailure("ana@example.com", "10.0.0.1")
+		if wait != tt.wait || locked != tt.locked {
+			t.Errorf("failure %d: RecordFailure = %v, %v, want %v, %v", tt.failure, wait, locked, tt.wait, tt.locked)
+		}
+		mr.FastForward(wait)
+	}
+}
+
+func TestLoginGuardClaimRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		wait     time.Duration
+		locked   bool
+	}{
+		{"within free attempts", 3, 0, false},
+		{"waiting", 4, time.Second, false},
+		{"locked", 7, 30 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, mr := newTestGuard(t, testLimits)
+			for i := 0; i < tt.failures; i++ {
+				g.Claim("ana", "10.0.0.1")
+				if i < tt.failures-1 {
+					wait, _ := g.RecordFailure("ana", "10.0.0.1")
+					mr.FastForward(wait)
+				}
+			}
+
+			wait, locked := g.Claim("ana", "10.0.0.2")
+			if wait != tt.wait || locked != tt.locked {
+				t.Errorf("Claim = %v, %v, want %v, %v", wait, locked, tt.wait, tt.locked)
+			}
+			// A refused attempt is not counted
+			if tt.wait > 0 && !tt.locked {
+				if got, _ := mr.Get(g.failKey("ana")); got != "4" {
+					t.Errorf("failures = %s after a refused attempt, want 4", got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginGuardIPLimit(t *testing.T) {
+	limits := testLimits
+	limits.MaxIPFailures = 3
+	g, _ := newTestGuard(t, limits)
+
+	for _, account := range []string{"a", "b", "c"} {
+		if wait, _ := g.Claim(account, "10.0.0.1"); wait != 0 {
+			t.Fatalf("Claim for %s refused with wait %v", account, wait)
+		}
+	}
+	if wait, locked := g.Claim("d", "10.0.0.1"); wait != limits.FailureWindow || locked {
+		t.Errorf("Claim over the IP limit = %v, %v, want %v, false", wait, locked, limits.FailureWindow)
+	}
+	if wait, _ := g.Claim("d", "10.0.0.2"); wait != 0 {
+		t.Errorf("Claim from another IP refused with wait %v", wait)
+	}
+}
+
+func TestLoginGuardSuccessAndRelease(t *testing.T) {
+	g, mr := newTestGuard(t, testLimits)
+	for i := 0; i < 3; i++ {
+		g.Claim("ana", "10.0.0.1")
+	}
+	g.Claim("budi", "10.0.0.1")
+
+	g.Release("ana", "10.0.0.1")
+	if got, _ := mr.Get(g.failKey("ana")); got != "2" {
+		t.Errorf("account failures after Release = %s, want 2", got)
+	}
+	if got, _ := mr.Get(g.ipKey("10.0.0.1")); got != "3" {
+		t.Errorf("IP failures after Release = %s, want 3", got)
+	}
+
+	g.Claim("ana", "10.0.0.1")
+	g.RecordSuccess("ana", "10.0.0.1")
+	if mr.Exists(g.failKey("ana")) || mr.Exists(g.delayKey("ana")) || mr.Exists(g.lockKey("ana")) {
+		t.Error("RecordSuccess left the account's failure history")
+	}
+	// Failures from other accounts on the same IP stay
+	if got, _ := mr.Get(g.ipKey("10.0.0.1")); got != "3" {
+		t.Errorf("IP failures after RecordSuccess = %s, want 3", got)
+	}
+}
+
+func TestLoginGuardUnlock(t *testing.T) {
+	g, _ := newTestGuard(t, testLimits)
+	g.limits.MaxAccountFailures = 1
+	g.Claim("ana", "10.0.0.1")
+	if _, locked := g.RecordFailure("ana", "10.0.0.1"); !locked {
+		t.Fatal("account not locked")
+	}
+	if err := g.Unlock("ana"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := g.Claim("ana", "10.0.0.1"); wait != 0 {
+		t.Errorf("Claim after Unlock refused with wait %v", wait)
+	}
+}
+
+func TestPINGuardThresholds(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	g := NewPINGuard(rdb, &config.Config{
+		LoginMaxDelay:    time.Minute,
+		PINMaxFailures:   3,
+		PINMaxIPFailures: 30,
+		PINLockDuration:  10 * time.Minute,
+	})
+
+	want := []struct {
+		wait   time.Duration
+		locked bool
+	}{
+		{0, false},
+		{time.Second, false},
+		{10 * time.Minute, true},
+	}
+	for i, w := range want {
+		g.Claim("ana", "10.0.0.1")
+		wait, locked := g.RecordFailure("ana", "10.0.0.1")
+		if wait != w.wait || locked != w.locked {
+			t.Errorf("failure %d: RecordFailure = %v, %v, want %v, %v", i+1, wait, locked, w.wait, w.locked)
+		}
+		if !locked {
+			mr.FastForward(wait)
+		}
+	}
+	if !mr.Exists("pin:lock:account:ana") {
+		t.Error("PIN guard does not use its own keys")
+	}
+}
+
+func TestLoginGuardWithoutRedis(t *testing.T) {
+	g := &LoginGuard{limits: testLimits}
+	for i := 0; i < 10; i++ {
+		if wait, locked := g.Claim("ana", "10.0.0.1"); wait != 0 || locked {
+			t.Fatalf("Claim without Redis = %v, %v", wait, locked)
+		}
+		if wait, locked := g.RecordFailure("ana", "10.0.0.1"); wait != 0 || locked {
+			t.Fatalf("RecordFailure without Redis = %v, %v", wait, locked)
+		}
+	}
+}
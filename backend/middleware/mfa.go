@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mfaPolicyTTL is how long role policies are cached before being reloaded, so
+// changes made on another instance apply within this period.
+const mfaPolicyTTL = time.Minute
+
+// MFAPolicy holds which roles must use two-factor authentication. Policies are
+// stored in mfa_role_policies and managed by admins.
+type MFAPolicy struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	required map[string]bool
+	loadedAt time.Time
+}
+
+func NewMFAPolicy(db *sql.DB) *MFAPolicy {
+	return &MFAPolicy{db: db}
+}
+
+// Required reports whether accounts with role must enroll in 2FA.
+func (p *MFAPolicy) Required(role string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.required == nil || time.Since(p.loadedAt) > mfaPolicyTTL {
+		if err := p.load(); err != nil {
+			log.Printf("Warning: failed to load MFA role policies: %v", err)
+		}
+	}
+	return p.required[role]
+}
+
+// Invalidate makes the next call to Required reload the policies.
+func (p *MFAPolicy) Invalidate() {
+	p.mu.Lock()
+	p.loadedAt = time.Time{}
+	p.mu.Unlock()
+}
+
+func (p *MFAPolicy) load() error {
+	rows, err := p.db.Query("SELECT role, required FROM mfa_role_policies")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	required := map[string]bool{}
+	for rows.Next() {
+		var role string
+		var req bool
+		if err := rows.Scan(&role, &req); err != nil {
+			return err
+		}
+		required[role] = req
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	p.required = required
+	p.loadedAt = time.Now()
+	return nil
+}
+
+// Enforce blocks callers whose role requires 2FA until they have enrolled.
+// Requests to a path starting with one of exempt (enrollment, logout) pass
+// through. It must run after AuthMiddleware.
+func (p *MFAPolicy) Enforce(exempt ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, _ := c.Locals("role").(string)
+		if !p.Required(role) {
+			return c.Next()
+		}
+
+		for _, prefix := range exempt {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+
+		var enrolled bool
+		p.db.QueryRow(`
+			SELECT mfa_enabled_at IS NOT NULL FROM users WHERE id = $1
+		`, c.Locals("userID")).Scan(&enrolled)
+		if enrolled {
+			return c.Next()
+		}
+
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":                   "Two-factor authentication must be set up for this account",
+			"mfa_enrollment_required": true,
+		})
+	}
+}
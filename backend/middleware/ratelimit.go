@@ -3,42 +3,62 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
 )
 
-func RateLimiter(rdb *redis.Client) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		if rdb == nil {
-			return c.Next()
-		}
+// ipRateLimit is how many requests an IP may make per minute.
+const ipRateLimit = 100
 
-		ctx := context.Background()
-		ip := c.IP()
-		key := fmt.Sprintf("ratelimit:%s", ip)
-
-		// Get current count
-		count, err := rdb.Get(ctx, key).Int()
-		if err != nil && err != redis.Nil {
-			// Redis error, allow request
-			return c.Next()
+// RateLimiter limits requests per IP. Paths under one of skipPrefixes are
+// left to a more specific limiter, such as APIKeyAuth.
+func RateLimiter(rdb *redis.Client, skipPrefixes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		for _, prefix := range skipPrefixes {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
 		}
 
-		// Check limit (100 requests per minute)
-		if count >= 100 {
+		if _, ok := allowRequest(rdb, fmt.Sprintf("ratelimit:%s", c.IP()), ipRateLimit); !ok {
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 				"error": "Rate limit exceeded. Please try again later.",
 			})
 		}
 
-		// Increment counter
-		pipe := rdb.Pipeline()
-		pipe.Incr(ctx, key)
-		pipe.Expire(ctx, key, time.Minute)
-		pipe.Exec(ctx)
-
 		return c.Next()
 	}
 }
+
+// allowRequest counts a request against key in a one-minute window and
+// reports how many requests are left. If Redis is unavailable every request
+// is allowed.
+func allowRequest(rdb *redis.Client, key string, limit int) (int, bool) {
+	if rdb == nil {
+		return limit, true
+	}
+
+	ctx := context.Background()
+
+	// Get current count
+	count, err := rdb.Get(ctx, key).Int()
+	if err != nil && err != redis.Nil {
+		// Redis error, allow request
+		return limit, true
+	}
+
+	if count >= limit {
+		return 0, false
+	}
+
+	// Increment counter
+	pipe := rdb.Pipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, time.Minute)
+	pipe.Exec(ctx)
+
+	return limit - count - 1, true
+}
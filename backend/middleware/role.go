@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	RoleStudent = "student"
+	RoleParent  = "parent"
+	RoleTeacher = "teacher"
+	RoleAdmin   = "admin"
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleStudent, RoleParent, RoleTeacher, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// RequireRole only lets callers whose token carries one of roles through.
+// It must run after AuthMiddleware.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, _ := c.Locals("role").(string)
+		for _, allowed := range roles {
+			if role == allowed {
+				return c.Next()
+			}
+		}
+
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have permission to access this resource",
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"database/sql"
+
+	"github.com/gili/backend/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireVerifiedEmail rejects users who have not confirmed their email
+// address. It is a no-op unless cfg.RequireVerifiedEmailForStory is set.
+func RequireVerifiedEmail(cfg *config.Config, db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !cfg.RequireVerifiedEmailForStory {
+			return c.Next()
+		}
+
+		userID := c.Locals("userID").(string)
+
+		// Managed child accounts have no email; their guardian vouches for them
+		var verified bool
+		err := db.QueryRow(`
+			SELECT email_verified_at IS NOT NULL OR email IS NULL FROM users WHERE id = $1
+		`, userID).Scan(&verified)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+
+		if !verified {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Please verify your email address first",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	EventType  string          `json:"event_type"`
+	ActorID    *string         `json:"actor_id,omitempty"`
+	ActorRole  *string         `json:"actor_role,omitempty"`
+	TargetID   *string         `json:"target_id,omitempty"`
+	TargetType *string         `json:"target_type,omitempty"`
+	SessionID  *string         `json:"session_id,omitempty"`
+	IPAddress  *string         `json:"ip_address,omitempty"`
+	UserAgent  *string         `json:"user_agent,omitempty"`
+	Metadata   json.RawMessage `json:"metadata"`
+	OccurredAt time.Time       `json:"occurred_at"`
+}
+
+type AuditEventListResponse struct {
+	Events []AuditEvent `json:"events"`
+	// NextBefore is passed as ?before= to fetch the next (older) page; it is
+	// omitted on the last page.
+	NextBefore *int64 `json:"next_before,omitempty"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+)
+
+// Child is a managed student account as seen by a linked guardian.
+type Child struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Username     string    `json:"username"`
+	LoginCode    string    `json:"login_code"`
+	Age          *int      `json:"age,omitempty"`
+	Level        string    `json:"level"`
+	Avatar       string    `json:"avatar"`
+	Relationship string    `json:"relationship"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type CreateChildRequest struct {
+	Name     string `json:"name" validate:"required,min=2,max=100"`
+	Username string `json:"username" validate:"required,min=3,max=30"`
+	PIN      string `json:"pin" validate:"required,numeric,min=4,max=6"`
+	Age      *int   `json:"age,omitempty" validate:"omitempty,min=5,max=17"`
+	Level    string `json:"level,omitempty" validate:"omitempty,oneof=sd smp sma"`
+	Avatar   string `json:"avatar,omitempty"`
+	// ConsentPolicyVersion is set by a parent who consents to the current
+	// privacy policy while creating the account.
+	ConsentPolicyVersion string `json:"consent_policy_version,omitempty"`
+}
+
+type ResetPINRequest struct {
+	PIN string `json:"pin" validate:"required,numeric,min=4,max=6"`
+}
+
+// ChildLoginRequest identifies the child by username or by the login code
+// printed on their class card.
+type ChildLoginRequest struct {
+	Username  string `json:"username,omitempty"`
+	LoginCode string `json:"login_code,omitempty"`
+	PIN       string `json:"pin" validate:"required,numeric,min=4,max=6"`
+	DeviceInfo
+}
+
+type ChildListResponse struct {
+	Children   []Child `json:"children"`
+	TotalCount int     `json:"total_count"`
+}
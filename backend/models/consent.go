@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// ConsentRecord documents who consented on behalf of a child, when, and to
+// which version of the privacy policy.
+type ConsentRecord struct {
+	ID            string    `json:"id"`
+	GuardianID    *string   `json:"guardian_id,omitempty"`
+	GuardianEmail *string   `json:"guardian_email,omitempty"`
+	Method        string    `json:"method"`
+	PolicyVersion string    `json:"policy_version"`
+	GrantedAt     time.Time `json:"granted_at"`
+}
+
+type ConsentStatusResponse struct {
+	Status        string          `json:"status"`
+	PolicyVersion string          `json:"policy_version"`
+	Records       []ConsentRecord `json:"records"`
+}
+
+type ConfirmConsentRequest struct {
+	Token         string `json:"token" validate:"required"`
+	PolicyVersion string `json:"policy_version" validate:"required"`
+}
+
+type GrantConsentRequest struct {
+	PolicyVersion string `json:"policy_version" validate:"required"`
+}
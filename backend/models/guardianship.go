@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+)
+
+// Guardianship is a link between a parent or teacher and a student, seen from
+// the side of the caller: Other is the person on the opposite end.
+type Guardianship struct {
+	ID           string     `json:"id"`
+	GuardianID   string     `json:"guardian_id"`
+	ChildID      string     `json:"child_id"`
+	OtherName    string     `json:"other_name"`
+	Relationship string     `json:"relationship"`
+	Status       string     `json:"status"`
+	ApprovedAt   *time.Time `json:"approved_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+type GuardianshipListResponse struct {
+	Guardianships []Guardianship `json:"guardianships"`
+	TotalCount    int            `json:"total_count"`
+}
+
+type GuardianInviteResponse struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type LinkGuardianRequest struct {
+	Code string `json:"code" validate:"required"`
+}
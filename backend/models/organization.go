@@ -0,0 +1,125 @@
+package models
+
+import (
+	"time"
+)
+
+// Organization is a school whose systems integrate with Gili through API
+// keys.
+type Organization struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type OrganizationListResponse struct {
+	Organizations []Organization `json:"organizations"`
+	TotalCount    int            `json:"total_count"`
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name" validate:"required,min=2,max=200"`
+}
+
+// APIKey describes an organization API key. The secret itself is only
+// returned once, when the key is created.
+type APIKey struct {
+	ID             string     `json:"id"`
+	OrganizationID string     `json:"organization_id"`
+	Name           string     `json:"name"`
+	KeyPrefix      string     `json:"key_prefix"`
+	Scopes         []string   `json:"scopes"`
+	RateLimit      int        `json:"rate_limit"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type APIKeyListResponse struct {
+	APIKeys    []APIKey `json:"api_keys"`
+	TotalCount int      `json:"total_count"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1"`
+	RateLimit     int      `json:"rate_limit,omitempty"`
+	ExpiresInDays *int     `json:"expires_in_days,omitempty" validate:"omitempty,min=1"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// RosterMember is a Gili account linked to an organization. Accounts are
+// identified to the school by its own external_id.
+type RosterMember struct {
+	UserID     string    `json:"user_id"`
+	ExternalID string    `json:"external_id"`
+	Role       string    `json:"role"`
+	ClassName  *string   `json:"class_name,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// OrganizationMembership is an organization the user belongs to, or has been
+// invited to by the school's roster sync.
+type OrganizationMembership struct {
+	OrganizationID   string     `json:"organization_id"`
+	OrganizationName string     `json:"organization_name"`
+	ClassName        *string    `json:"class_name,omitempty"`
+	Status           string     `json:"status"`
+	ApprovedAt       *time.Time `json:"approved_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+type OrganizationMembershipListResponse struct {
+	Memberships []OrganizationMembership `json:"memberships"`
+	TotalCount  int                      `json:"total_count"`
+}
+
+type AddOrganizationMemberRequest struct {
+	UserID     string `json:"user_id" validate:"required"`
+	ExternalID string `json:"external_id" validate:"required,max=100"`
+	ClassName  string `json:"class_name,omitempty" validate:"omitempty,max=100"`
+}
+
+type RosterResponse struct {
+	Members    []RosterMember `json:"members"`
+	TotalCount int            `json:"total_count"`
+}
+
+type RosterEntry struct {
+	ExternalID string `json:"external_id" validate:"required,max=100"`
+	Email      string `json:"email,omitempty"`
+	Username   string `json:"username,omitempty"`
+	ClassName  string `json:"class_name,omitempty" validate:"omitempty,max=100"`
+}
+
+type SyncRosterRequest struct {
+	Members []RosterEntry `json:"members" validate:"required,max=1000"`
+}
+
+// SyncRosterResponse does not say which entries matched an account, so that
+// the roster cannot be used to find out who has one.
+type SyncRosterResponse struct {
+	Received int `json:"received"`
+}
+
+type SkillAggregate struct {
+	Skill           string  `json:"skill"`
+	AverageLevel    float64 `json:"average_level"`
+	AverageProgress float64 `json:"average_progress"`
+}
+
+// OrganizationProgressResponse summarises the learning progress of an
+// organization's students. Nothing is reported for fewer students than the
+// minimum group size, so that no single student can be singled out.
+type OrganizationProgressResponse struct {
+	StudentCount     int              `json:"student_count"`
+	CompletedStories int              `json:"completed_stories"`
+	Skills           []SkillAggregate `json:"skills"`
+	MinGroupSize     int              `json:"min_group_size"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+type DeleteAccountRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+type AccountDeletionResponse struct {
+	Message             string    `json:"message"`
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+}
+
+// DataExport is an archive of a user's personal data. DownloadURL is set once
+// the archive is ready.
+type DataExport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	SizeBytes   *int64     `json:"size_bytes,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
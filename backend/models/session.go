@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// DeviceInfo is sent by the app on login so that sessions can be told apart.
+type DeviceInfo struct {
+	DeviceName string `json:"device_name,omitempty" validate:"omitempty,max=100"`
+	Platform   string `json:"platform,omitempty" validate:"omitempty,max=20"`
+	AppVersion string `json:"app_version,omitempty" validate:"omitempty,max=50"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	DeviceName *string   `json:"device_name,omitempty"`
+	Platform   *string   `json:"platform,omitempty"`
+	AppVersion *string   `json:"app_version,omitempty"`
+	IPAddress  *string   `json:"ip_address,omitempty"`
+	Current    bool      `json:"current"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type SessionListResponse struct {
+	Sessions   []Session `json:"sessions"`
+	TotalCount int       `json:"total_count"`
+}
@@ -5,18 +5,24 @@ import (
 )
 
 type Story struct {
-	ID          string         `json:"id"`
-	UserID      string         `json:"user_id"`
-	PromptID    *string        `json:"prompt_id,omitempty"`
-	PromptTitle *string        `json:"prompt_title,omitempty"`
-	InputType   string         `json:"input_type"`
-	Content     *string        `json:"content,omitempty"`
-	AudioURL    *string        `json:"audio_url,omitempty"`
-	Transcript  *string        `json:"transcript,omitempty"`
-	Status      string         `json:"status"`
-	Feedback    *StoryFeedback `json:"feedback,omitempty"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
+	ID              string         `json:"id"`
+	UserID          string         `json:"user_id"`
+	PromptID        *string        `json:"prompt_id,omitempty"`
+	PromptTitle     *string        `json:"prompt_title,omitempty"`
+	InputType       string         `json:"input_type"`
+	Content         *string        `json:"content,omitempty"`
+	AudioURL        *string        `json:"audio_url,omitempty"`
+	AudioDurationMs *int           `json:"audio_duration_ms,omitempty"`
+	Transcript      *string        `json:"transcript,omitempty"`
+	Status          string         `json:"status"`
+	Revision        int            `json:"revision"`
+	Attempts        int            `json:"attempts"`
+	NextRetryAt     *time.Time     `json:"next_retry_at,omitempty"`
+	DeletedAt       *time.Time     `json:"deleted_at,omitempty"`
+	RestoreUntil    *time.Time     `json:"restore_until,omitempty"`
+	Feedback        *StoryFeedback `json:"feedback,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
 }
 
 type StoryFeedback struct {
@@ -40,11 +46,89 @@ type CreateStoryRequest struct {
 	Content     string `json:"content,omitempty" validate:"required_if=InputType text"`
 }
 
+type UpdateStoryRequest struct {
+	Content string `json:"content"`
+}
+
+// StoryScores are the evaluation scores of one revision.
+type StoryScores struct {
+	Clarity    int `json:"clarity"`
+	Structure  int `json:"structure"`
+	Creativity int `json:"creativity"`
+	Expression int `json:"expression"`
+	Overall    int `json:"overall"`
+}
+
+// Sub returns the change from before to s, per dimension.
+func (s StoryScores) Sub(before StoryScores) StoryScores {
+	return StoryScores{
+		Clarity:    s.Clarity - before.Clarity,
+		Structure:  s.Structure - before.Structure,
+		Creativity: s.Creativity - before.Creativity,
+		Expression: s.Expression - before.Expression,
+		Overall:    s.Overall - before.Overall,
+	}
+}
+
+// StoryRevision is one version of a story. Scores is nil until the revision
+// has been evaluated; Delta compares it with the previous evaluated
+// revision.
+type StoryRevision struct {
+	Revision     int          `json:"revision"`
+	InputType    string       `json:"input_type"`
+	Content      *string      `json:"content,omitempty"`
+	Transcript   *string      `json:"transcript,omitempty"`
+	Status       string       `json:"status"`
+	Scores       *StoryScores `json:"scores,omitempty"`
+	Delta        *StoryScores `json:"delta,omitempty"`
+	FeedbackText *string      `json:"feedback_text,omitempty"`
+	Current      bool         `json:"current"`
+	SubmittedAt  time.Time    `json:"submitted_at"`
+}
+
+// RevisionComparison is the score change between two evaluated revisions.
+type RevisionComparison struct {
+	From  int         `json:"from"`
+	To    int         `json:"to"`
+	Delta StoryScores `json:"delta"`
+}
+
+type StoryRevisionsResponse struct {
+	StoryID    string              `json:"story_id"`
+	Revisions  []StoryRevision     `json:"revisions"`
+	Comparison *RevisionComparison `json:"comparison,omitempty"`
+}
+
 type StoryListResponse struct {
-	Stories    []Story `json:"stories"`
-	TotalCount int     `json:"total_count"`
-	Page       int     `json:"page"`
-	PageSize   int     `json:"page_size"`
+	Stories []Story `json:"stories"`
+	// NextCursor is passed as ?cursor= to fetch the next page; it is omitted
+	// on the last page.
+	NextCursor *string `json:"next_cursor,omitempty"`
+	// TotalCount and Page are only set for numbered pages (?page=).
+	TotalCount *int `json:"total_count,omitempty"`
+	Page       int  `json:"page,omitempty"`
+	PageSize   int  `json:"page_size"`
+}
+
+// StorySearchResult is a story matching a search, with fragments of the
+// matching text. Matched words are wrapped in <mark></mark>.
+type StorySearchResult struct {
+	ID              string    `json:"id"`
+	PromptTitle     *string   `json:"prompt_title,omitempty"`
+	InputType       string    `json:"input_type"`
+	Status          string    `json:"status"`
+	OverallScore    *int      `json:"overall_score,omitempty"`
+	Snippet         string    `json:"snippet"`
+	FeedbackSnippet *string   `json:"feedback_snippet,omitempty"`
+	Rank            float64   `json:"rank"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type StorySearchResponse struct {
+	Query    string              `json:"query"`
+	Results  []StorySearchResult `json:"results"`
+	Page     int                 `json:"page"`
+	PageSize int                 `json:"page_size"`
 }
 
 type TimelineItem struct {
@@ -61,3 +145,42 @@ type TimelineResponse struct {
 	Items      []TimelineItem `json:"items"`
 	TotalCount int            `json:"total_count"`
 }
+
+// Outcomes of syncing one offline story.
+const (
+	SyncCreated  = "created"  // stored and queued for evaluation
+	SyncExists   = "exists"   // already synced; nothing changed
+	SyncDeleted  = "deleted"  // already synced and since deleted
+	SyncConflict = "conflict" // the ID belongs to someone else's story
+	SyncInvalid  = "invalid"  // rejected; see Error
+	SyncFailed   = "failed"   // server error; send again later
+)
+
+// SyncStoryItem is a story saved on the device while offline. ID is chosen
+// by the app so the item can be sent again safely.
+type SyncStoryItem struct {
+	ID          string `json:"id"`
+	InputType   string `json:"input_type"`
+	PromptID    string `json:"prompt_id,omitempty"`
+	PromptTitle string `json:"prompt_title,omitempty"`
+	Content     string `json:"content,omitempty"`
+	RecordedAt  string `json:"recorded_at,omitempty"`
+}
+
+type SyncStoriesRequest struct {
+	Stories []SyncStoryItem `json:"stories"`
+}
+
+type SyncStoryResult struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SyncStoriesResponse struct {
+	Results []SyncStoryResult `json:"results"`
+	Created int               `json:"created"`
+	Skipped int               `json:"skipped"`
+	Failed  int               `json:"failed"`
+}
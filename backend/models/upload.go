@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// UploadSession is a resumable recording upload. StoryID is set once the
+// last byte has arrived and the story has been created, with ClientStoryID
+// as its ID when the app chose one.
+type UploadSession struct {
+	ID            string     `json:"id"`
+	UploadLength  int64      `json:"upload_length"`
+	UploadOffset  int64      `json:"upload_offset"`
+	PromptID      *string    `json:"prompt_id,omitempty"`
+	PromptTitle   *string    `json:"prompt_title,omitempty"`
+	ClientStoryID *string    `json:"-"`
+	RecordedAt    *time.Time `json:"recorded_at,omitempty"`
+	StoryID       *string    `json:"story_id,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
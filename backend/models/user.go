@@ -5,15 +5,20 @@ import (
 )
 
 type User struct {
-	ID           string    `json:"id"`
-	Name         string    `json:"name"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Age          *int      `json:"age,omitempty"`
-	Level        string    `json:"level"`
-	Avatar       string    `json:"avatar"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                  string     `json:"id"`
+	Name                string     `json:"name"`
+	Email               string     `json:"email,omitempty"`
+	Username            *string    `json:"username,omitempty"`
+	PasswordHash        string     `json:"-"`
+	Age                 *int       `json:"age,omitempty"`
+	Level               string     `json:"level"`
+	Avatar              string     `json:"avatar"`
+	Role                string     `json:"role"`
+	ConsentStatus       string     `json:"consent_status"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 }
 
 type RegisterRequest struct {
@@ -22,18 +27,22 @@ type RegisterRequest struct {
 	Password string `json:"password" validate:"required,min=6"`
 	Age      *int   `json:"age,omitempty" validate:"omitempty,min=5,max=100"`
 	Level    string `json:"level,omitempty" validate:"omitempty,oneof=sd smp sma kuliah"`
+	Role     string `json:"role,omitempty" validate:"omitempty,oneof=student parent"`
+	DeviceInfo
 }
 
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
+	DeviceInfo
 }
 
 type AuthResponse struct {
-	User         *User  `json:"user"`
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int64  `json:"expires_in"`
+	User                  *User  `json:"user"`
+	AccessToken           string `json:"access_token"`
+	RefreshToken          string `json:"refresh_token"`
+	ExpiresIn             int64  `json:"expires_in"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
 }
 
 type RefreshRequest struct {
@@ -46,3 +55,26 @@ type UpdateProfileRequest struct {
 	Level  string `json:"level,omitempty" validate:"omitempty,oneof=sd smp sma kuliah"`
 	Avatar string `json:"avatar,omitempty"`
 }
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=6"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Email       string `json:"email" validate:"required,email"`
+	Code        string `json:"code" validate:"required,len=6"`
+	NewPassword string `json:"new_password" validate:"required,min=6"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=student parent teacher admin"`
+}
@@ -0,0 +1,351 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// maxMediaBytes caps the size of a single recording copied into an export.
+const maxMediaBytes = 50 * 1024 * 1024
+
+var mediaClient = &http.Client{Timeout: 30 * time.Second}
+
+// exportSections are the JSON files in an export archive. Each query takes the
+// user ID as $1 and returns a single JSON document built by Postgres.
+var exportSections = []struct {
+	file  string
+	query string
+}{
+	{"profile.json", `
+		SELECT row_to_json(u) FROM (
+			SELECT id, name, email, username, age, level, avatar, role, consent_status,
+			       email_verified_at, deletion_scheduled_at, created_at, updated_at
+			FROM users WHERE id = $1
+		) u`},
+	{"stories.json", `
+		SELECT COALESCE(json_agg(s ORDER BY s.created_at), '[]') FROM (
+			SELECT st.id, st.prompt_id, st.prompt_title, st.input_type, st.content, st.audio_url,
+			       st.transcript, st.status, st.created_at, st.updated_at, st.deleted_at,
+			       (SELECT row_to_json(f) FROM (
+			           SELECT clarity_score, structure_score, creativity_score, expression_score,
+			                  overall_score, feedback_text, strengths, improvements, created_at
+			           FROM story_feedback WHERE story_id = st.id
+			       ) f) AS feedback,
+			       st.revision,
+			       (SELECT COALESCE(json_agg(r ORDER BY r.revision), '[]') FROM (
+			           SELECT revision, input_type, content, transcript, status,
+			                  clarity_score, structure_score, creativity_score, expression_score,
+			                  overall_score, feedback_text, strengths, improvements,
+			                  submitted_at, evaluated_at
+			           FROM story_revisions WHERE story_id = st.id
+			       ) r) AS earlier_revisions
+			FROM stories st WHERE st.user_id = $1
+		) s`},
+	{"skill_progress.json", `
+		SELECT COALESCE(json_agg(p ORDER BY p.skill), '[]') FROM (
+			SELECT sk.name AS skill, sp.level, sp.progress, sp.total_stories, sp.updated_at
+			FROM skill_progress sp JOIN skills sk ON sk.id = sp.skill_id
+			WHERE sp.user_id = $1
+		) p`},
+	{"sessions.json", `
+		SELECT COALESCE(json_agg(s ORDER BY s.created_at), '[]') FROM (
+			SELECT id, device_name, platform, app_version, ip_address, created_at, last_used_at, revoked_at
+			FROM sessions WHERE user_id = $1
+		) s`},
+	{"guardianships.json", `
+		SELECT COALESCE(json_agg(g ORDER BY g.created_at), '[]') FROM (
+			SELECT g.id, g.relationship, g.status, g.created_at, g.approved_at,
+			       CASE WHEN g.child_id = $1 THEN 'guardian' ELSE 'child' END AS other_party_role,
+			       u.name AS other_party_name
+			FROM guardianships g
+			JOIN users u ON u.id = CASE WHEN g.child_id = $1 THEN g.guardian_id ELSE g.child_id END
+			WHERE g.child_id = $1 OR g.guardian_id = $1
+		) g`},
+	{"consent_records.json", `
+		SELECT COALESCE(json_agg(r ORDER BY r.granted_at), '[]') FROM (
+			SELECT id, guardian_id, guardian_email, method, policy_version, granted_at
+			FROM consent_records WHERE child_id = $1
+		) r`},
+	{"organizations.json", `
+		SELECT COALESCE(json_agg(o ORDER BY o.created_at), '[]') FROM (
+			SELECT org.name AS organization, m.external_id, m.class_name, m.status, m.approved_at,
+			       m.created_at, m.updated_at
+			FROM organization_members m JOIN organizations org ON org.id = m.organization_id
+			WHERE m.user_id = $1
+		) o`},
+	// The IP address and user agent of events by someone else, such as an
+	// admin or a failed login by another person, are not the user's data
+	{"security_events.json", `
+		SELECT COALESCE(json_agg(e ORDER BY e.id), '[]') FROM (
+			SELECT id, event_type,
+			       CASE WHEN actor_id = $1 THEN ip_address END AS ip_address,
+			       CASE WHEN actor_id = $1 THEN user_agent END AS user_agent,
+			       occurred_at
+			FROM audit_events WHERE actor_id = $1 OR target_id = $1
+		) e`},
+}
+
+type exportManifest struct {
+	ExportID     string    `json:"export_id"`
+	UserID       string    `json:"user_id"`
+	GeneratedAt  time.Time `json:"generated_at"`
+	Files        []string  `json:"files"`
+	MissingMedia []string  `json:"missing_media,omitempty"`
+}
+
+// processExport builds the archive for a pending export. Exports already
+// claimed by another worker are skipped.
+func (w *Worker) processExport(exportID string) {
+	var userID string
+	err := w.db.QueryRow(`
+		UPDATE data_exports SET status = 'processing', started_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND (status = 'pending' OR (status = 'processing' AND started_at < $2))
+		RETURNING user_id
+	`, exportID, time.Now().Add(-exportRequeueAfter)).Scan(&userID)
+	if err != nil {
+		return
+	}
+
+	filePath, size, err := w.buildArchive(exportID, userID)
+	if err != nil {
+		log.Printf("Data export %s failed: %v", exportID, err)
+		w.db.Exec(`
+			UPDATE data_exports SET status = 'failed', error = $1, completed_at = CURRENT_TIMESTAMP
+			WHERE id = $2
+		`, err.Error(), exportID)
+		return
+	}
+
+	_, err = w.db.Exec(`
+		UPDATE data_exports
+		SET status = 'ready', file_path = $1, size_bytes = $2,
+		    completed_at = CURRENT_TIMESTAMP, expires_at = $3
+		WHERE id = $4
+	`, filePath, size, time.Now().Add(w.cfg.DataExportExpiry), exportID)
+	if err != nil {
+		log.Printf("Failed to mark data export %s ready: %v", exportID, err)
+		os.Remove(filePath)
+	}
+}
+
+// buildArchive writes a zip with one JSON file per section plus the user's
+// recordings under media/, and returns its path and size.
+func (w *Worker) buildArchive(exportID, userID string) (string, int64, error) {
+	if err := os.MkdirAll(w.cfg.DataExportDir, 0o700); err != nil {
+		return "", 0, fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	finalPath := filepath.Join(w.cfg.DataExportDir, exportID+".zip")
+	tmpPath := finalPath + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	zw := zip.NewWriter(f)
+	manifest := exportManifest{ExportID: exportID, UserID: userID, GeneratedAt: time.Now().UTC()}
+
+	for _, section := range exportSections {
+		var raw []byte
+		if err := w.db.QueryRow(section.query, userID).Scan(&raw); err != nil {
+			f.Close()
+			return "", 0, fmt.Errorf("%s: %w", section.file, err)
+		}
+
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+			pretty.Reset()
+			pretty.Write(raw)
+		}
+
+		if err := writeZipFile(zw, section.file, &pretty); err != nil {
+			f.Close()
+			return "", 0, err
+		}
+		manifest.Files = append(manifest.Files, section.file)
+	}
+
+	media, err := w.mediaFiles(userID)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	for storyID, m := range media {
+		var name string
+		if m.key != "" {
+			name, err = w.copyBlob(zw, storyID, m.key)
+		} else {
+			name, err = copyMedia(zw, storyID, m.audioURL)
+		}
+		if err != nil {
+			log.Printf("Data export %s: skipping recording of story %s: %v", exportID, storyID, err)
+			manifest.MissingMedia = append(manifest.MissingMedia, storyID)
+			continue
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeZipFile(zw, "manifest.json", bytes.NewReader(manifestJSON)); err != nil {
+		f.Close()
+		return "", 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return "", 0, err
+	}
+	return finalPath, info.Size(), nil
+}
+
+// mediaFile locates a story recording: in blob storage for uploaded
+// recordings, otherwise at an external URL.
+type mediaFile struct {
+	audioURL string
+	key      string
+}
+
+// mediaFiles returns the recording of every audio story, keyed by story ID,
+// and of earlier audio revisions, keyed by story ID and revision ("<id>-r1").
+func (w *Worker) mediaFiles(userID string) (map[string]mediaFile, error) {
+	rows, err := w.db.Query(`
+		SELECT id, COALESCE(audio_url, ''), COALESCE(audio_key, '') FROM stories
+		WHERE user_id = $1 AND (audio_url IS NOT NULL OR audio_key IS NOT NULL)
+		UNION ALL
+		SELECT r.story_id || '-r' || r.revision, '', r.audio_key
+		FROM story_revisions r JOIN stories s ON s.id = r.story_id
+		WHERE s.user_id = $1 AND r.audio_key IS NOT NULL
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	media := map[string]mediaFile{}
+	for rows.Next() {
+		var id string
+		var m mediaFile
+		if err := rows.Scan(&id, &m.audioURL, &m.key); err == nil {
+			media[id] = m
+		}
+	}
+	return media, rows.Err()
+}
+
+// copyBlob copies an uploaded recording from blob storage into the archive.
+func (w *Worker) copyBlob(zw *zip.Writer, storyID, key string) (string, error) {
+	body, size, err := w.blobs.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if size > maxMediaBytes {
+		return "", errors.New("recording too large")
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxMediaBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxMediaBytes {
+		return "", errors.New("recording too large")
+	}
+
+	name := "media/" + storyID + path.Ext(key)
+	return name, writeZipFile(zw, name, bytes.NewReader(data))
+}
+
+func copyMedia(zw *zip.Writer, storyID, audioURL string) (string, error) {
+	u, err := url.Parse(audioURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", errors.New("unsupported recording location")
+	}
+
+	resp, err := mediaClient.Get(audioURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxMediaBytes {
+		return "", errors.New("recording too large")
+	}
+
+	// Read the whole recording first so a failed download leaves no partial
+	// entry in the archive
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMediaBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxMediaBytes {
+		return "", errors.New("recording too large")
+	}
+
+	ext := path.Ext(u.Path)
+	if ext == "" {
+		ext = ".audio"
+	}
+	name := "media/" + storyID + ext
+
+	return name, writeZipFile(zw, name, bytes.NewReader(data))
+}
+
+func writeZipFile(zw *zip.Writer, name string, r io.Reader) error {
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// removeExpiredExports deletes archives past their download window.
+func (w *Worker) removeExpiredExports() {
+	rows, err := w.db.Query(`
+		DELETE FROM data_exports
+		WHERE expires_at < CURRENT_TIMESTAMP
+		   OR (status = 'failed' AND completed_at < $1)
+		RETURNING COALESCE(file_path, '')
+	`, time.Now().Add(-w.cfg.DataExportExpiry))
+	if err != nil {
+		log.Printf("Warning: failed to remove expired data exports: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err == nil && filePath != "" {
+			os.Remove(filePath)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package privacy
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gili/backend/audit"
+)
+
+// deletedUserName replaces the name of an anonymised account.
+const deletedUserName = "Pengguna Terhapus"
+
+// purgeStatements remove everything tied to a user except the anonymised
+// users row (kept so IDs referenced elsewhere stay valid) and consent records,
+// which are retained as proof of consent. The audit log is append-only: its
+// events stay, referring to the user by ID, but their IP addresses and user
+// agents are removed. Each takes the user ID as $1.
+var purgeStatements = []string{
+	`DELETE FROM stories WHERE user_id = $1`,
+	`DELETE FROM skill_progress WHERE user_id = $1`,
+	`DELETE FROM refresh_tokens WHERE user_id = $1`,
+	`UPDATE sessions
+	 SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP),
+	     device_name = NULL, platform = NULL, app_version = NULL, ip_address = NULL
+	 WHERE user_id = $1`,
+	`DELETE FROM password_resets WHERE user_id = $1`,
+	`DELETE FROM email_verifications WHERE user_id = $1`,
+	`DELETE FROM guardianships WHERE guardian_id = $1 OR child_id = $1`,
+	`DELETE FROM guardianship_invites WHERE child_id = $1`,
+	`DELETE FROM consent_requests WHERE child_id = $1`,
+	`DELETE FROM mfa_totp WHERE user_id = $1`,
+	`DELETE FROM mfa_recovery_codes WHERE user_id = $1`,
+	`DELETE FROM mfa_challenges WHERE user_id = $1`,
+	`DELETE FROM organization_members WHERE user_id = $1`,
+	`DELETE FROM upload_sessions WHERE user_id = $1`,
+	`UPDATE audit_events SET ip_address = NULL, user_agent = NULL
+	 WHERE (actor_id = $1 OR target_id = $1) AND (ip_address IS NOT NULL OR user_agent IS NOT NULL)`,
+	`UPDATE users
+	 SET name = '` + deletedUserName + `', email = NULL, username = NULL, login_code = NULL,
+	     password_hash = NULL, pin_hash = NULL, age = NULL, avatar = NULL,
+	     email_verified_at = NULL, mfa_enabled_at = NULL, deletion_scheduled_at = NULL,
+	     deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	 WHERE id = $1`,
+}
+
+// purgeDeletedAccounts anonymises accounts whose deletion grace period is over.
+func (w *Worker) purgeDeletedAccounts() {
+	rows, err := w.db.Query(`
+		SELECT id FROM users
+		WHERE deletion_scheduled_at <= CURRENT_TIMESTAMP AND deleted_at IS NULL
+		LIMIT 50
+	`)
+	if err != nil {
+		log.Printf("Warning: failed to list accounts due for deletion: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := w.anonymize(id); err != nil {
+			log.Printf("Failed to delete account %s: %v", id, err)
+			continue
+		}
+		log.Printf("Deleted account %s after grace period", id)
+	}
+}
+
+func (w *Worker) anonymize(userID string) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM data_exports WHERE user_id = $1 RETURNING COALESCE(file_path, '')`, userID)
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err == nil && filePath != "" {
+			files = append(files, filePath)
+		}
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`
+		SELECT audio_key FROM stories WHERE user_id = $1 AND audio_key IS NOT NULL
+		UNION
+		SELECT r.audio_key FROM story_revisions r JOIN stories s ON s.id = r.story_id
+		WHERE s.user_id = $1 AND r.audio_key IS NOT NULL
+	`, userID)
+	if err != nil {
+		return err
+	}
+	blobKeys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			blobKeys = append(blobKeys, key)
+		}
+	}
+	rows.Close()
+
+	for _, stmt := range purgeStatements {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		os.Remove(f)
+	}
+	for _, key := range blobKeys {
+		if err := w.blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("Warning: failed to delete recording %s of account %s: %v", key, userID, err)
+		}
+	}
+	w.denylist.DenyUser(userID)
+	w.audit.Record(audit.Event{
+		Type:       audit.AccountDeleted,
+		TargetID:   userID,
+		TargetType: audit.TargetUser,
+	})
+	return nil
+}
+
+// purgeDeletedStories removes stories deleted longer than STORY_RESTORE_WINDOW
+// ago, with their feedback, revisions and recordings.
+func (w *Worker) purgeDeletedStories() {
+	rows, err := w.db.Query(`
+		SELECT id FROM stories WHERE deleted_at < $1
+		ORDER BY deleted_at
+		LIMIT 50
+	`, time.Now().Add(-w.cfg.StoryRestoreWindow))
+	if err != nil {
+		log.Printf("Warning: failed to list deleted stories: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := w.purgeStory(id); err != nil {
+			log.Printf("Failed to remove deleted story %s: %v", id, err)
+		}
+	}
+}
+
+func (w *Worker) purgeStory(storyID string) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT audio_key FROM stories WHERE id = $1 AND audio_key IS NOT NULL
+		UNION
+		SELECT audio_key FROM story_revisions WHERE story_id = $1 AND audio_key IS NOT NULL
+	`, storyID)
+	if err != nil {
+		return err
+	}
+	blobKeys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			blobKeys = append(blobKeys, key)
+		}
+	}
+	rows.Close()
+
+	// Feedback and revisions go with the story
+	res, err := tx.Exec(`DELETE FROM stories WHERE id = $1 AND deleted_at < $2`,
+		storyID, time.Now().Add(-w.cfg.StoryRestoreWindow))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Restored in the meantime
+		return nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, key := range blobKeys {
+		if err := w.blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("Warning: failed to delete recording %s of story %s: %v", key, storyID, err)
+		}
+	}
+	return nil
+}
+
+// redactAuditEvents removes IP addresses and user agents from audit events
+// older than AUDIT_PERSONAL_DATA_RETENTION. The events themselves are kept.
+func (w *Worker) redactAuditEvents() {
+	res, err := w.db.Exec(`
+		UPDATE audit_events SET ip_address = NULL, user_agent = NULL
+		WHERE id IN (
+			SELECT id FROM audit_events
+			WHERE occurred_at < $1 AND (ip_address IS NOT NULL OR user_agent IS NOT NULL)
+			LIMIT 1000
+		)
+	`, time.Now().Add(-w.cfg.AuditPersonalDataRetention))
+	if err != nil {
+		log.Printf("Warning: failed to redact old audit events: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Removed IP addresses and user agents from %d audit events", n)
+	}
+}
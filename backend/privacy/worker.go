@@ -0,0 +1,97 @@
+package privacy
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/gili/backend/audit"
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/database"
+	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/storage"
+)
+
+// sweepInterval is how often the worker purges accounts past their grace
+// period and stories past their restore window, removes personal data from
+// old audit events, removes expired exports and picks up exports whose queue
+// message was lost.
+const sweepInterval = time.Minute
+
+// exportRequeueAfter is how long an export may sit in pending (or stay in
+// processing after a crash) before the sweep builds it itself.
+const exportRequeueAfter = 5 * time.Minute
+
+// Worker builds personal data exports and anonymises accounts whose deletion
+// grace period has passed.
+type Worker struct {
+	db       *sql.DB
+	cfg      *config.Config
+	rmq      *database.RabbitMQ
+	denylist *middleware.TokenDenylist
+	blobs    storage.BlobStore
+	audit    *audit.Recorder
+}
+
+func NewWorker(db *sql.DB, cfg *config.Config, rmq *database.RabbitMQ, denylist *middleware.TokenDenylist, blobs storage.BlobStore, rec *audit.Recorder) *Worker {
+	return &Worker{db: db, cfg: cfg, rmq: rmq, denylist: denylist, blobs: blobs, audit: rec}
+}
+
+// Start consumes the data_export queue and runs the periodic sweep. It
+// returns immediately.
+func (w *Worker) Start() {
+	if w.rmq != nil {
+		deliveries, err := w.rmq.Consume("data_export")
+		if err != nil {
+			log.Printf("Warning: failed to consume data_export queue: %v", err)
+		} else {
+			go func() {
+				for d := range deliveries {
+					w.processExport(string(d.Body))
+					d.Ack(false)
+				}
+			}()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.sweep()
+		}
+	}()
+}
+
+func (w *Worker) sweep() {
+	w.purgeDeletedAccounts()
+	w.purgeDeletedStories()
+	w.redactAuditEvents()
+	w.removeExpiredExports()
+
+	rows, err := w.db.Query(`
+		SELECT id FROM data_exports
+		WHERE (status = 'pending' AND created_at < $1)
+		   OR (status = 'processing' AND started_at < $1)
+		ORDER BY created_at
+		LIMIT 10
+	`, time.Now().Add(-exportRequeueAfter))
+	if err != nil {
+		log.Printf("Warning: failed to list stale data exports: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		w.processExport(id)
+	}
+}
@@ -0,0 +1,178 @@
+// Package retry puts stories whose transcription or evaluation failed back on
+// their queue, automatically with exponential backoff or when the student
+// asks for it.
+package retry
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/database"
+)
+
+// sweepInterval is how often stories due for a retry are requeued.
+const sweepInterval = 30 * time.Second
+
+// maxDelay caps the backoff between attempts.
+const maxDelay = time.Hour
+
+// stalePending is how long a story may wait for the AI worker before its
+// evaluation message is assumed lost and published again.
+const stalePending = 10 * time.Minute
+
+// Delay returns how long to wait before the next attempt of a story that
+// has failed attempts times: cfg.StoryRetryDelay, doubling per attempt. The
+// AI worker computes the same schedule.
+func Delay(cfg *config.Config, attempts int) time.Duration {
+	d := cfg.StoryRetryDelay
+	for i := 1; i < attempts && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	return d
+}
+
+// NextRetryAt returns when a story that has just failed its attempts-th
+// attempt should be retried, or nil once it has used up cfg.StoryMaxAttempts.
+func NextRetryAt(cfg *config.Config, attempts int) *time.Time {
+	if attempts >= cfg.StoryMaxAttempts {
+		return nil
+	}
+	t := time.Now().Add(Delay(cfg, attempts))
+	return &t
+}
+
+// Requeue moves a failed story back to the stage that failed and publishes
+// it. It returns the new status, or sql.ErrNoRows if the story is not in a
+// failed state.
+func Requeue(db *sql.DB, rmq *database.RabbitMQ, storyID string) (string, error) {
+	return requeue(db, rmq, storyID, 0, math.MaxInt32)
+}
+
+// RequeueManual is Requeue for a retry asked for by the student. It also
+// returns sql.ErrNoRows if the story failed less than interval ago or has
+// already been attempted maxAttempts times.
+func RequeueManual(db *sql.DB, rmq *database.RabbitMQ, storyID string, interval time.Duration, maxAttempts int) (string, error) {
+	return requeue(db, rmq, storyID, interval, maxAttempts)
+}
+
+func requeue(db *sql.DB, rmq *database.RabbitMQ, storyID string, interval time.Duration, maxAttempts int) (string, error) {
+	var status string
+	err := db.QueryRow(`
+		UPDATE stories
+		SET status = CASE status WHEN 'transcription_failed' THEN 'pending_transcription' ELSE 'pending' END,
+		    next_retry_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('failed', 'transcription_failed') AND deleted_at IS NULL
+		  AND updated_at <= CURRENT_TIMESTAMP - make_interval(secs => $2) AND attempts < $3
+		RETURNING status
+	`, storyID, interval.Seconds(), maxAttempts).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+
+	if status == "pending_transcription" {
+		err = rmq.PublishStoryTranscription(storyID)
+	} else {
+		err = rmq.PublishStoryEvaluation(storyID)
+	}
+	if err != nil {
+		// The workers' sweeps pick up stories left waiting
+		log.Printf("Warning: failed to requeue story %s: %v", storyID, err)
+	}
+	return status, nil
+}
+
+// Worker requeues failed stories once their next_retry_at has passed.
+type Worker struct {
+	db  *sql.DB
+	rmq *database.RabbitMQ
+}
+
+func NewWorker(db *sql.DB, rmq *database.RabbitMQ) *Worker {
+	return &Worker{db: db, rmq: rmq}
+}
+
+// Start runs the periodic sweep. It returns immediately.
+func (w *Worker) Start() {
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.sweep()
+		}
+	}()
+}
+
+func (w *Worker) sweep() {
+	rows, err := w.db.Query(`
+		SELECT id FROM stories
+		WHERE next_retry_at <= CURRENT_TIMESTAMP AND status IN ('failed', 'transcription_failed')
+		  AND deleted_at IS NULL
+		ORDER BY next_retry_at
+		LIMIT 20
+	`)
+	if err != nil {
+		log.Printf("Warning: failed to list stories due for retry: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := Requeue(w.db, w.rmq, id); err != nil && err != sql.ErrNoRows {
+			log.Printf("Failed to retry story %s: %v", id, err)
+		}
+	}
+
+	w.republishStale()
+}
+
+// republishStale publishes stories again whose evaluation message was lost,
+// e.g. while RabbitMQ was down.
+func (w *Worker) republishStale() {
+	if w.rmq == nil {
+		return
+	}
+
+	rows, err := w.db.Query(`
+		UPDATE stories SET updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM stories WHERE status = 'pending' AND updated_at < $1 AND deleted_at IS NULL
+			ORDER BY updated_at LIMIT 20
+		)
+		RETURNING id
+	`, time.Now().Add(-stalePending))
+	if err != nil {
+		log.Printf("Warning: failed to list stories awaiting evaluation: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := w.rmq.PublishStoryEvaluation(id); err != nil {
+			log.Printf("Warning: failed to queue story %s for evaluation: %v", id, err)
+			return
+		}
+	}
+}
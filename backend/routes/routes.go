@@ -3,20 +3,62 @@ package routes
 import (
 	"database/sql"
 
+	"github.com/gili/backend/audit"
 	"github.com/gili/backend/config"
 	"github.com/gili/backend/database"
+	"github.com/gili/backend/events"
 	"github.com/gili/backend/handlers"
+	"github.com/gili/backend/mailer"
 	"github.com/gili/backend/middleware"
+	"github.com/gili/backend/storage"
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
 )
 
-func Setup(app *fiber.App, db *sql.DB, rdb *redis.Client, rmq *database.RabbitMQ, cfg *config.Config) {
+func Setup(app *fiber.App, db *sql.DB, rdb *redis.Client, rmq *database.RabbitMQ, mail mailer.Mailer, keys *middleware.KeyManager, blobs storage.BlobStore, hub *events.Hub, cfg *config.Config) {
+	// Access token revocation
+	denylist := middleware.NewTokenDenylist(rdb, db, cfg.JWTRefreshExpiry)
+
+	// Failed login tracking
+	guard := middleware.NewLoginGuard(rdb, cfg)
+	pinGuard := middleware.NewPINGuard(rdb, cfg)
+
+	// Roles that must use two-factor authentication
+	mfaPolicy := middleware.NewMFAPolicy(db)
+
+	// Security audit log
+	rec := audit.NewRecorder(db)
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, cfg)
-	userHandler := handlers.NewUserHandler(db, cfg)
-	storyHandler := handlers.NewStoryHandler(db, cfg, rmq)
+	authHandler := handlers.NewAuthHandler(db, cfg, keys, denylist, guard, pinGuard, mail, mfaPolicy, rec)
+	sessionHandler := handlers.NewSessionHandler(db, cfg, denylist, rec)
+	userHandler := handlers.NewUserHandler(db, cfg, denylist, rec)
+	storyHandler := handlers.NewStoryHandler(db, cfg, rmq, blobs)
+	uploadHandler := handlers.NewUploadHandler(db, cfg, blobs, storyHandler)
+	eventHandler := handlers.NewEventHandler(hub, denylist)
+	uploadHandler.StartCleanup()
 	skillHandler := handlers.NewSkillHandler(db, cfg)
+	childHandler := handlers.NewChildHandler(db, cfg, denylist, pinGuard, rec)
+	guardianshipHandler := handlers.NewGuardianshipHandler(db, cfg, rec)
+	consentHandler := handlers.NewConsentHandler(db, cfg, mail, rec)
+	privacyHandler := handlers.NewPrivacyHandler(db, cfg, rmq, denylist, rec)
+	mfaHandler := handlers.NewMFAHandler(db, cfg, denylist, mfaPolicy, rec)
+	adminHandler := handlers.NewAdminHandler(db, cfg, denylist, guard, pinGuard, mfaPolicy, rec)
+	auditHandler := handlers.NewAuditHandler(db)
+	organizationHandler := handlers.NewOrganizationHandler(db, cfg, rec)
+	integrationHandler := handlers.NewIntegrationHandler(db, cfg, rec)
+	jwksHandler := handlers.NewJWKSHandler(keys)
+
+	// Role policies
+	studentOnly := middleware.RequireRole(middleware.RoleStudent)
+	guardianOnly := middleware.RequireRole(middleware.RoleParent, middleware.RoleTeacher)
+	parentOnly := middleware.RequireRole(middleware.RoleParent)
+	linkedGuardian := middleware.RequireGuardian(db)
+	adminOnly := middleware.RequireRole(middleware.RoleAdmin)
+	adultOnly := middleware.RequireRole(middleware.RoleParent, middleware.RoleTeacher, middleware.RoleAdmin)
+
+	// Public keys for verifying tokens in other services
+	app.Get("/.well-known/jwks.json", jwksHandler.GetJWKS)
 
 	// API v1 group
 	api := app.Group("/api/v1")
@@ -25,28 +67,137 @@ func Setup(app *fiber.App, db *sql.DB, rdb *redis.Client, rmq *database.RabbitMQ
 	auth := api.Group("/auth")
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
+	auth.Post("/child-login", authHandler.ChildLogin)
 	auth.Post("/refresh", authHandler.RefreshToken)
+	auth.Post("/forgot-password", authHandler.ForgotPassword)
+	auth.Post("/reset-password", authHandler.ResetPassword)
+	auth.Post("/verify-email", authHandler.VerifyEmail)
+	auth.Post("/mfa/verify", authHandler.VerifyMFA)
+
+	// tus capability discovery for resumable uploads
+	api.Options("/uploads", uploadHandler.GetOptions)
+
+	// Guardian consent from an emailed link (no account needed)
+	api.Post("/consent/confirm", consentHandler.ConfirmConsent)
 
-	// Protected routes (auth required)
-	protected := api.Group("", middleware.AuthMiddleware(cfg))
+	// School system integrations, authenticated with an organization API key
+	// instead of a user token
+	integrations := api.Group("/integrations", middleware.APIKeyAuth(db, rdb))
+	integrations.Get("/roster", middleware.RequireScope(middleware.ScopeRosterRead), integrationHandler.GetRoster)
+	integrations.Put("/roster", middleware.RequireScope(middleware.ScopeRosterWrite), integrationHandler.SyncRoster)
+	integrations.Delete("/roster/:externalId", middleware.RequireScope(middleware.ScopeRosterWrite), integrationHandler.RemoveRosterMember)
+	integrations.Get("/progress", middleware.RequireScope(middleware.ScopeProgressRead), integrationHandler.GetProgress)
+
+	// Protected routes (auth required). Accounts whose role requires 2FA can
+	// only reach 2FA setup and logout until they have enrolled.
+	protected := api.Group("", middleware.AuthMiddleware(keys, denylist, rec),
+		mfaPolicy.Enforce("/api/v1/auth/mfa", "/api/v1/auth/logout"))
 
 	// Auth
 	protected.Post("/auth/logout", authHandler.Logout)
+	protected.Post("/auth/resend-verification", authHandler.ResendVerification)
+	protected.Get("/auth/sessions", sessionHandler.GetSessions)
+	protected.Delete("/auth/sessions", sessionHandler.RevokeOtherSessions)
+	protected.Delete("/auth/sessions/:id", sessionHandler.RevokeSession)
+
+	// Two-factor authentication (adult accounts)
+	protected.Get("/auth/mfa", adultOnly, mfaHandler.GetStatus)
+	protected.Post("/auth/mfa/setup", adultOnly, mfaHandler.Setup)
+	protected.Post("/auth/mfa/confirm", adultOnly, mfaHandler.Confirm)
+	protected.Post("/auth/mfa/recovery-codes", adultOnly, mfaHandler.RegenerateRecoveryCodes)
+	protected.Delete("/auth/mfa", adultOnly, mfaHandler.Disable)
 
 	// User
 	protected.Get("/user/profile", userHandler.GetProfile)
 	protected.Put("/user/profile", userHandler.UpdateProfile)
+	protected.Put("/user/password", userHandler.ChangePassword)
+	protected.Get("/user/consent", consentHandler.GetConsent)
+	protected.Post("/user/consent/request", studentOnly, consentHandler.RequestConsent)
 
-	// Stories
-	protected.Post("/stories", storyHandler.CreateStory)
-	protected.Get("/stories", storyHandler.GetStories)
-	protected.Get("/stories/:id", storyHandler.GetStory)
+	// Personal data rights (UU PDP)
+	protected.Delete("/user", privacyHandler.DeleteAccount)
+	protected.Post("/user/deletion/cancel", privacyHandler.CancelDeletion)
+	protected.Get("/user/export", privacyHandler.GetExport)
+	protected.Get("/user/export/:exportId/download", privacyHandler.DownloadExport)
+
+	// Stories (students only)
+	protected.Post("/stories", studentOnly, middleware.RequireVerifiedEmail(cfg, db), storyHandler.CreateStory)
+	protected.Post("/sync/stories", studentOnly, middleware.RequireVerifiedEmail(cfg, db), storyHandler.SyncStories)
+	protected.Post("/stories/audio", studentOnly, middleware.RequireVerifiedEmail(cfg, db), middleware.RequireConsent(db), storyHandler.UploadAudioStory)
+	protected.Get("/stories", studentOnly, storyHandler.GetStories)
+	protected.Get("/stories/search", studentOnly, storyHandler.SearchStories)
+	protected.Get("/stories/deleted", studentOnly, storyHandler.GetDeletedStories)
+	protected.Get("/stories/events", studentOnly, eventHandler.StreamStoryEvents)
+	protected.Get("/stories/:id", studentOnly, storyHandler.GetStory)
+	protected.Delete("/stories/:id", studentOnly, storyHandler.DeleteStory)
+	protected.Post("/stories/:id/restore", studentOnly, storyHandler.RestoreStory)
+	protected.Put("/stories/:id", studentOnly, middleware.RequireVerifiedEmail(cfg, db), storyHandler.UpdateStory)
+	protected.Get("/stories/:id/audio", studentOnly, storyHandler.GetStoryAudio)
+	protected.Get("/stories/:id/revisions", studentOnly, storyHandler.GetStoryRevisions)
+	protected.Post("/stories/:id/retry", studentOnly, storyHandler.RetryStory)
+
+	// Resumable recording uploads (tus)
+	uploads := protected.Group("/uploads", studentOnly, uploadHandler.Protocol)
+	uploads.Post("/", middleware.RequireVerifiedEmail(cfg, db), middleware.RequireConsent(db), uploadHandler.CreateUpload)
+	uploads.Head("/:id", uploadHandler.HeadUpload)
+	uploads.Get("/:id", uploadHandler.GetUpload)
+	uploads.Patch("/:id", uploadHandler.PatchUpload)
+	uploads.Delete("/:id", uploadHandler.DeleteUpload)
 
 	// Timeline
-	protected.Get("/timeline", storyHandler.GetTimeline)
+	protected.Get("/timeline", studentOnly, storyHandler.GetTimeline)
 
 	// Skills & Progress
 	protected.Get("/skills", skillHandler.GetSkills)
-	protected.Get("/progress", skillHandler.GetProgress)
-	protected.Get("/portfolio", skillHandler.GetPortfolio)
+	protected.Get("/progress", studentOnly, skillHandler.GetProgress)
+	protected.Get("/portfolio", studentOnly, skillHandler.GetPortfolio)
+
+	// Managed child accounts (parents and teachers)
+	protected.Post("/children", guardianOnly, childHandler.CreateChild)
+	protected.Get("/children", guardianOnly, childHandler.GetChildren)
+	protected.Put("/children/:id/pin", guardianOnly, childHandler.ResetPIN)
+
+	// Read-only view of a linked child's learning data
+	protected.Get("/children/:id/progress", guardianOnly, linkedGuardian, skillHandler.GetProgress)
+	protected.Get("/children/:id/timeline", guardianOnly, linkedGuardian, storyHandler.GetTimeline)
+	protected.Get("/children/:id/portfolio", guardianOnly, linkedGuardian, skillHandler.GetPortfolio)
+
+	// Parental consent for a linked child
+	protected.Get("/children/:id/consent", guardianOnly, linkedGuardian, consentHandler.GetConsent)
+	protected.Post("/children/:id/consent", parentOnly, linkedGuardian, consentHandler.GrantConsent)
+
+	// Personal data rights exercised by a guardian for a child
+	protected.Delete("/children/:id", guardianOnly, linkedGuardian, privacyHandler.DeleteAccount)
+	protected.Post("/children/:id/deletion/cancel", guardianOnly, linkedGuardian, privacyHandler.CancelDeletion)
+	protected.Get("/children/:id/export", guardianOnly, linkedGuardian, privacyHandler.GetExport)
+	protected.Get("/children/:id/export/:exportId/download", guardianOnly, linkedGuardian, privacyHandler.DownloadExport)
+
+	// Guardian linking
+	protected.Get("/guardianships", guardianshipHandler.GetGuardianships)
+	protected.Post("/guardianships/invites", studentOnly, guardianshipHandler.CreateInvite)
+	protected.Post("/guardianships", guardianOnly, guardianshipHandler.LinkGuardian)
+	protected.Post("/guardianships/:id/approve", guardianshipHandler.ApproveGuardianship)
+	protected.Delete("/guardianships/:id", guardianshipHandler.Unlink)
+
+	// Schools the user belongs to or is invited to by a roster sync
+	protected.Get("/organizations", organizationHandler.GetMemberships)
+	protected.Post("/organizations/:id/accept", organizationHandler.AcceptMembership)
+	protected.Delete("/organizations/:id", organizationHandler.LeaveOrganization)
+
+	// Admin
+	admin := protected.Group("/admin", adminOnly)
+	admin.Put("/users/:id/role", adminHandler.UpdateUserRole)
+	admin.Post("/users/:id/ban", adminHandler.BanUser)
+	admin.Delete("/users/:id/ban", adminHandler.UnbanUser)
+	admin.Post("/users/:id/unlock", adminHandler.UnlockUser)
+	admin.Delete("/users/:id/mfa", adminHandler.ResetUserMFA)
+	admin.Get("/mfa/policies", adminHandler.GetMFAPolicies)
+	admin.Put("/mfa/policies/:role", adminHandler.UpdateMFAPolicy)
+	admin.Get("/audit-events", auditHandler.GetEvents)
+	admin.Post("/organizations", organizationHandler.CreateOrganization)
+	admin.Get("/organizations", organizationHandler.GetOrganizations)
+	admin.Post("/organizations/:id/members", organizationHandler.AddMember)
+	admin.Post("/organizations/:id/api-keys", organizationHandler.CreateAPIKey)
+	admin.Get("/organizations/:id/api-keys", organizationHandler.GetAPIKeys)
+	admin.Delete("/organizations/:id/api-keys/:keyId", organizationHandler.RevokeAPIKey)
 }
@@ -0,0 +1,47 @@
+// Package storage keeps uploaded files such as story recordings behind a
+// BlobStore, backed by the local filesystem or an S3-compatible service.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gili/backend/config"
+)
+
+// ErrNotFound is returned by Get when no blob is stored under the key.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque blobs under slash-separated keys such as
+// "stories/<user>/<story>.m4a".
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any blob
+	// already there.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob under key and returns its size.
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Delete removes the blob under key. Deleting a missing blob is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the BlobStore selected by cfg.BlobDriver.
+func New(cfg *config.Config) (BlobStore, error) {
+	switch cfg.BlobDriver {
+	case "local":
+		return NewLocalStore(cfg.BlobLocalDir)
+	case "s3":
+		return NewS3Store(S3Options{
+			Endpoint:     cfg.S3Endpoint,
+			Region:       cfg.S3Region,
+			Bucket:       cfg.S3Bucket,
+			AccessKey:    cfg.S3AccessKey,
+			SecretKey:    cfg.S3SecretKey,
+			UsePathStyle: cfg.S3UsePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown blob driver %q", cfg.BlobDriver)
+	}
+}
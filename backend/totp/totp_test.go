@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed from RFC 6238 appendix B, "12345678901234567890".
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// TestCodeRFC6238 checks the SHA1 test vectors of RFC 6238 appendix B. The
+// RFC lists 8-digit codes; with 6 digits they keep their last 6.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatalf("Code: %v", err)
+			}
+			if code != tt.code {
+				t.Errorf("Code = %s, want %s", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name   string
+		code   string
+		want   bool
+		atStep int64
+	}{
+		{"current step", "050471", true, step},
+		{"with spaces", " 050 471 ", true, step},
+		{"previous step", codeAt(t, step-1), true, step - 1},
+		{"next step", codeAt(t, step+1), true, step + 1},
+		{"two steps old", codeAt(t, step-2), false, 0},
+		{"wrong code", "123456", false, 0},
+		{"too short", "05047", false, 0},
+		{"eight digits", "14050471", false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.want || got != tt.atStep {
+				t.Errorf("Validate = %d, %v, want %d, %v", got, ok, tt.atStep, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBadSecret(t *testing.T) {
+	if _, ok := Validate("not base32!", "123456", time.Now()); ok {
+		t.Error("Validate accepted a code for an invalid secret")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Fatalf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("Code with a generated secret: %v", err)
+	}
+}
+
+func codeAt(t *testing.T, step int64) string {
+	t.Helper()
+	code, err := Code(rfcSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
@@ -0,0 +1,98 @@
+package transcribe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// OpenAIOptions configures an OpenAI transcriber.
+type OpenAIOptions struct {
+	// BaseURL is the API root, e.g. "https://api.openai.com/v1". Other
+	// services exposing the same /audio/transcriptions endpoint also work.
+	BaseURL  string
+	APIKey   string
+	Model    string
+	Language string
+}
+
+// OpenAI transcribes with the OpenAI audio transcription API (Whisper).
+type OpenAI struct {
+	opts   OpenAIOptions
+	client *http.Client
+}
+
+func NewOpenAI(opts OpenAIOptions) (*OpenAI, error) {
+	if opts.APIKey == "" {
+		return nil, errors.New("OPENAI_API_KEY is required for the openai transcriber")
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+	// Timeouts come from the caller's context
+	return &OpenAI{opts: opts, client: &http.Client{}}, nil
+}
+
+func (t *OpenAI) Transcribe(ctx context.Context, r io.Reader, filename, contentType string) (string, error) {
+	// Stream the form so the recording is not buffered twice
+	body, w := io.Pipe()
+	form := multipart.NewWriter(w)
+	go func() {
+		w.CloseWithError(t.writeForm(form, r, filename))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.BaseURL+"/audio/transcriptions", body)
+	if err != nil {
+		body.Close()
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.opts.APIKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("transcription API: status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("transcription API: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+func (t *OpenAI) writeForm(form *multipart.Writer, r io.Reader, filename string) error {
+	fields := map[string]string{
+		"model":           t.opts.Model,
+		"language":        t.opts.Language,
+		"response_format": "json",
+	}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	return form.Close()
+}
@@ -0,0 +1,59 @@
+// Package transcribe turns story recordings into text before they are
+// evaluated. Speech-to-text providers sit behind the Transcriber interface.
+package transcribe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/gili/backend/config"
+)
+
+// Transcriber converts a recording to text.
+type Transcriber interface {
+	// Transcribe reads the recording from r. filename carries the extension
+	// some providers use to pick a decoder.
+	Transcribe(ctx context.Context, r io.Reader, filename, contentType string) (string, error)
+}
+
+// New returns the Transcriber selected by cfg.Transcriber. There is no
+// default: without a provider every recording would be scored against the
+// stub's sentence.
+func New(cfg *config.Config) (Transcriber, error) {
+	switch cfg.Transcriber {
+	case "":
+		return nil, fmt.Errorf("TRANSCRIBER is not set; use openai, or stub for development")
+	case "stub":
+		log.Printf("WARNING: TRANSCRIBER=stub, audio stories get a fixed transcript instead of what was said; do not use this in production")
+		return Stub{}, nil
+	case "openai":
+		return NewOpenAI(OpenAIOptions{
+			BaseURL:  cfg.TranscribeAPIURL,
+			APIKey:   cfg.TranscribeAPIKey,
+			Model:    cfg.TranscribeModel,
+			Language: cfg.TranscribeLanguage,
+		})
+	default:
+		return nil, fmt.Errorf("unknown transcriber %q", cfg.Transcriber)
+	}
+}
+
+// Stub returns a fixed transcript that depends only on the recording's
+// bytes, so the pipeline can run in development and tests without a
+// speech-to-text provider.
+type Stub struct{}
+
+func (Stub) Transcribe(ctx context.Context, r io.Reader, filename, contentType string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"Pada suatu hari aku pergi ke sekolah bersama teman-temanku. Kami belajar dan bermain bersama. (rekaman %s)",
+		hex.EncodeToString(h.Sum(nil))[:8],
+	), nil
+}
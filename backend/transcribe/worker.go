@@ -0,0 +1,171 @@
+package transcribe
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"path"
+	"time"
+
+	"github.com/gili/backend/config"
+	"github.com/gili/backend/database"
+	"github.com/gili/backend/retry"
+	"github.com/gili/backend/storage"
+)
+
+// sweepInterval is how often the worker picks up stories whose queue message
+// was lost.
+const sweepInterval = time.Minute
+
+// requeueAfter is how long a story may wait for transcription before the
+// sweep transcribes it itself. Stories stuck in transcribing after a crash
+// are picked up once the transcription timeout has passed as well.
+const requeueAfter = 5 * time.Minute
+
+// Worker transcribes uploaded recordings from the story_transcription queue
+// and hands the stories on to story_evaluation. A story moves through
+// pending_transcription → transcribing → pending, or ends in
+// transcription_failed, from where package retry requeues it.
+type Worker struct {
+	db          *sql.DB
+	cfg         *config.Config
+	rmq         *database.RabbitMQ
+	blobs       storage.BlobStore
+	transcriber Transcriber
+}
+
+func NewWorker(db *sql.DB, cfg *config.Config, rmq *database.RabbitMQ, blobs storage.BlobStore, t Transcriber) *Worker {
+	return &Worker{db: db, cfg: cfg, rmq: rmq, blobs: blobs, transcriber: t}
+}
+
+// Start consumes the story_transcription queue and runs the periodic sweep.
+// It returns immediately.
+func (w *Worker) Start() {
+	if w.rmq != nil {
+		deliveries, err := w.rmq.Consume("story_transcription")
+		if err != nil {
+			log.Printf("Warning: failed to consume story_transcription queue: %v", err)
+		} else {
+			go func() {
+				for d := range deliveries {
+					w.process(string(d.Body))
+					d.Ack(false)
+				}
+			}()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.sweep()
+		}
+	}()
+}
+
+func (w *Worker) sweep() {
+	rows, err := w.db.Query(`
+		SELECT id FROM stories
+		WHERE deleted_at IS NULL AND (
+		      (status = 'pending_transcription' AND updated_at < $1)
+		   OR (status = 'transcribing' AND updated_at < $2))
+		ORDER BY created_at
+		LIMIT 10
+	`, time.Now().Add(-requeueAfter), time.Now().Add(-requeueAfter-w.cfg.TranscribeTimeout))
+	if err != nil {
+		log.Printf("Warning: failed to list stories awaiting transcription: %v", err)
+		return
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		w.process(id)
+	}
+}
+
+// process transcribes one story. Stories already claimed by another worker
+// are skipped.
+func (w *Worker) process(storyID string) {
+	var key, contentType string
+	var attempts int
+	err := w.db.QueryRow(`
+		UPDATE stories SET status = 'transcribing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND audio_key IS NOT NULL AND deleted_at IS NULL
+		  AND (status = 'pending_transcription' OR (status = 'transcribing' AND updated_at < $2))
+		RETURNING audio_key, COALESCE(audio_content_type, ''), attempts
+	`, storyID, time.Now().Add(-requeueAfter-w.cfg.TranscribeTimeout)).Scan(&key, &contentType, &attempts)
+	if err != nil {
+		return
+	}
+
+	transcript, err := w.transcribe(key, contentType)
+	if err != nil {
+		log.Printf("Transcription of story %s failed (attempt %d): %v", storyID, attempts, err)
+		w.db.Exec(`
+			UPDATE stories
+			SET status = 'transcription_failed', last_error = $1, next_retry_at = $2,
+			    updated_at = CURRENT_TIMESTAMP
+			WHERE id = $3 AND status = 'transcribing'
+		`, truncateError(err), retry.NextRetryAt(w.cfg, attempts), storyID)
+		return
+	}
+
+	// Evaluation gets its own attempts
+	res, err := w.db.Exec(`
+		UPDATE stories
+		SET transcript = $1, status = 'pending', attempts = 0, last_error = NULL,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = 'transcribing'
+	`, transcript, storyID)
+	if err != nil {
+		log.Printf("Failed to save transcript of story %s: %v", storyID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	if err := w.rmq.PublishStoryEvaluation(storyID); err != nil {
+		log.Printf("Warning: failed to queue story %s for evaluation: %v", storyID, err)
+	}
+}
+
+// truncateError keeps error messages stored on stories short.
+func truncateError(err error) string {
+	msg := err.Error()
+	if len(msg) > 500 {
+		msg = msg[:500]
+	}
+	return msg
+}
+
+func (w *Worker) transcribe(key, contentType string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.TranscribeTimeout)
+	defer cancel()
+
+	body, _, err := w.blobs.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	transcript, err := w.transcriber.Transcribe(ctx, body, path.Base(key), contentType)
+	if err != nil {
+		return "", err
+	}
+	if transcript == "" {
+		return "", errors.New("no speech recognised")
+	}
+	return transcript, nil
+}